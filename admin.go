@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Admin endpoints are served on their own listener, AdminListen, and require
+// an "Authorization: Bearer <AdminToken>" header if AdminToken is set and a
+// client certificate signed by AdminClientCAFile if it is set.
+
+// ServeAdmin serves the admin endpoints on AdminListen, using TLS if
+// AdminTLSCertFile is set
+func ServeAdmin(live *LiveConfiguration, cache *Cache) error {
+	config := live.Load()
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/cacheStats", makeAdminHandler(live, cache, StatsHandler))
+	adminMux.HandleFunc("/purge", makeAdminHandler(live, cache, PurgeHandler))
+	adminMux.HandleFunc("/prewarm", makeAdminHandler(live, cache, PrewarmHandler))
+	adminMux.HandleFunc("/metrics", makeAdminHandler(live, cache, MetricsHandler))
+	adminMux.HandleFunc("/reload", makeAdminHandler(live, cache, live.ReloadHandler))
+	server := &http.Server{Addr: config.AdminListen, Handler: adminMux}
+	if config.AdminTLSCertFile == "" {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.AdminClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.AdminClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates in " + config.AdminClientCAFile)
+		}
+		server.TLSConfig.ClientCAs = clientCAs
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return server.ListenAndServeTLS(config.AdminTLSCertFile, config.AdminTLSKeyFile)
+}
+
+func makeAdminHandler(live *LiveConfiguration, cache *Cache, handler func(Configuration, *Cache, http.ResponseWriter, *http.Request) (int, error)) func(http.ResponseWriter, *http.Request) {
+	// admin requests, metrics scrapes included, are kept out of responses_total
+	return handleRequests(live, cache, func(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (int, error) {
+		if config.AdminToken != "" {
+			auth := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(auth, "Bearer ")
+			// a bare token, without the scheme, is rejected too
+			if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				return http.StatusUnauthorized, errors.New("bad admin token")
+			}
+		}
+		return handler(config, cache, w, r)
+	}, false)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// StatsHandler returns transfer and cache size counters (GET /cacheStats)
+func StatsHandler(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (int, error) {
+	return writeJSON(w, cache.getStats())
+}
+
+// PurgeHandler removes a path (POST /purge?path=some/file.ext) or every path
+// under a prefix (POST /purge?prefix=some/dir/) from the cache
+func PurgeHandler(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errors.New("purge requires POST")
+	}
+	q := r.URL.Query()
+	path, isPrefix := q.Get("path"), false
+	if prefix := q.Get("prefix"); prefix != "" {
+		path, isPrefix = prefix, true
+	}
+	if path == "" {
+		return http.StatusBadRequest, errors.New("missing path or prefix")
+	}
+	stats, cacheError := cache.Purge(path, isPrefix)
+	if cacheError != nil {
+		return cacheError.status, cacheError
+	}
+	return writeJSON(w, stats)
+}
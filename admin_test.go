@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cachedFiles returns the files on disk under prefix of the cache directory
+func cachedFiles(t *testing.T, c *Cache, prefix string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(c.cacheDir, func(fullPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(strings.TrimPrefix(fullPath, c.cacheDir+string(filepath.Separator)))
+		if !f.IsDir() && strings.HasPrefix(path, prefix) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestPurge(t *testing.T) {
+	provider := newStubProvider(map[string]stubFile{
+		"dir/small": {body: "hello"},
+		"dir/big":   {body: slicedBody, etag: `"v1"`},
+		"dir/slow":  {body: "slowly"},
+		"dira/file": {body: "kept"},
+		"video":     {body: slicedBody, etag: `"v1"`},
+		"other":     {body: "also"},
+	})
+	c := newTestCache(t, Configuration{SliceSizeInBytes: 4, SliceThresholdInBytes: 8, NegativeTTLInSeconds: 60}, provider)
+	for _, path := range []string{"dir/small", "dir/big", "dira/file", "video", "other"} {
+		if _, cacheError := get(c, path, nil); cacheError != nil {
+			t.Fatalf("%s: %s", path, cacheError)
+		}
+	}
+	if _, cacheError := get(c, "dir/missing", nil); cacheError == nil || cacheError.status != http.StatusNotFound {
+		t.Fatalf("got %v, want a 404 error", cacheError)
+	}
+	halfway, resume := provider.gate()
+	done := make(chan *CacheError)
+	go func() {
+		_, cacheError := get(c, "dir/slow", nil)
+		done <- cacheError
+	}()
+	<-halfway
+	f := runningFill(t, c, "dir/slow")
+
+	stats, cacheError := c.Purge("dir/", true)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	// dir/small, dir/big with its 5 slices and the 404 of dir/missing
+	if stats.Purged != 8 || stats.BytesFreed != int64(len("hello")+len(slicedBody)) {
+		t.Errorf("got %+v, want 8 purged and %d bytes freed", stats, len("hello")+len(slicedBody))
+	}
+	resume()
+	if cacheError := <-done; cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if f.waitDone() != nil {
+		t.Fatal("fill failed")
+	}
+	if files := cachedFiles(t, c, "dir/"); len(files) != 0 {
+		t.Errorf("files left on disk: %v", files)
+	}
+	if paths, _ := ListPathsWithPrefix(c.db, "dir/"); len(paths) != 0 {
+		t.Errorf("records left: %v", paths)
+	}
+	if _, found, _ := GetMissingFile(c.db, "dir/missing"); found {
+		t.Error("404 of dir/missing kept")
+	}
+	checkCached(t, c, "dir/slow", "")
+	checkCached(t, c, "dira/file", "kept")
+	checkCached(t, c, "other", "also")
+
+	// purging a path takes its slices along, but not other paths it prefixes
+	stats, cacheError = c.Purge("/video", false)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if stats.Purged != 6 || stats.BytesFreed != int64(len(slicedBody)) {
+		t.Errorf("got %+v, want 6 purged and %d bytes freed", stats, len(slicedBody))
+	}
+	if files := cachedFiles(t, c, "video"); len(files) != 0 {
+		t.Errorf("files left on disk: %v", files)
+	}
+	checkCached(t, c, "other", "also")
+
+	// everything left is indexed for eviction, nothing else
+	paths, err := ListPathsWithPrefix(c.db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, c.db.DB, evictionPrefix); n != len(paths) {
+		t.Errorf("got %d eviction keys for %d records", n, len(paths))
+	}
+	if len(paths) != 2 {
+		t.Errorf("got records %v, want dira/file and other", paths)
+	}
+}
+
+func TestPurgeHandler(t *testing.T) {
+	provider := newStubProvider(map[string]stubFile{"a/file": {body: "hello"}, "a/other": {body: "world!"}})
+	c := newTestCache(t, Configuration{}, provider)
+	for _, path := range []string{"a/file", "a/other"} {
+		if _, cacheError := get(c, path, nil); cacheError != nil {
+			t.Fatal(cacheError)
+		}
+	}
+	tests := []struct {
+		method string
+		query  string
+		status int
+		stats  PurgeStats
+	}{
+		{"GET", "path=a/file", http.StatusMethodNotAllowed, PurgeStats{}},
+		{"POST", "", http.StatusBadRequest, PurgeStats{}},
+		{"POST", "path=a/../b", http.StatusBadRequest, PurgeStats{}},
+		{"POST", "path=a/file", http.StatusOK, PurgeStats{1, 5}},
+		{"POST", "path=a/file", http.StatusOK, PurgeStats{0, 0}},
+		{"POST", "prefix=a/", http.StatusOK, PurgeStats{1, 6}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/purge?"+test.query, nil)
+		w := httptest.NewRecorder()
+		status, err := PurgeHandler(Configuration{}, c, w, r)
+		if status != test.status {
+			t.Errorf("%s %s: got %d (%v), want %d", test.method, test.query, status, err, test.status)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		var stats PurgeStats
+		if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats != test.stats {
+			t.Errorf("%s %s: got %+v, want %+v", test.method, test.query, stats, test.stats)
+		}
+	}
+	// fetched again after being purged
+	if _, cacheError := get(c, "a/file", nil); cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if n := provider.count("Read a/file"); n != 2 {
+		t.Errorf("origin got %d reads, want 2", n)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	c := newTestCache(t, Configuration{}, newStubProvider(nil))
+	live := NewLiveConfiguration(nil, Configuration{AdminToken: "s3cret"}, c)
+	handler := makeAdminHandler(live, c, StatsHandler)
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", http.StatusUnauthorized},
+		{"bare token", "s3cret", http.StatusUnauthorized},
+		{"other scheme", "Basic s3cret", http.StatusUnauthorized},
+		{"bearer token", "Bearer s3cret", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/cacheStats", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: no WWW-Authenticate challenge", test.name)
+		}
+	}
+}
@@ -23,28 +23,50 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	pathLib "path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexandres/poormanscdn/client"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type StorageProvider interface {
 	Read(path string, w *CacheWriter) *StorageProviderError
-	//Stat(path string) (Stat, error)
+	// ReadRange reads length bytes of path starting at offset. The bytes must
+	// come from the version of the file described by the ETag, size and
+	// modification time of version, it fails with 412 if origin has another.
+	ReadRange(path string, offset int64, length int64, version Stat, w *CacheWriter) *StorageProviderError
+	Stat(path string) (Stat, *StorageProviderError)
+}
+
+func GetStorageProvider(config Configuration) (StorageProvider, error) {
+	switch config.StorageBackend {
+	case StorageBackendFilesystem:
+		return GetFilesystemClient(config)
+	case StorageBackendHTTP:
+		return GetHTTPOriginClient(config)
+	default:
+		return GetS3Client(config)
+	}
+}
+
+// StorageLister is implemented by storage providers that can list the files
+// under a prefix
+type StorageLister interface {
+	List(prefix string) ([]string, *StorageProviderError)
 }
 
 type StorageProviderError struct {
@@ -52,6 +74,12 @@ type StorageProviderError struct {
 	error
 }
 
+// originFailed reports whether the error comes from origin being unreachable,
+// slow or broken rather than from the file itself
+func (e *StorageProviderError) originFailed() bool {
+	return e.status >= http.StatusInternalServerError || e.status == http.StatusRequestTimeout
+}
+
 type CacheError struct {
 	status int
 	error
@@ -62,10 +90,172 @@ type Stat struct {
 	SizeInBytes    uint64
 	LastModifiedAt time.Time
 	ETag           string
+	// Header holds the origin headers replayed to clients, see storedHeaders
+	Header http.Header
+	// ExpiresAt is when the file becomes stale, zero if it never does
+	ExpiresAt time.Time
+	// NoStore is set when origin forbids caching the file
+	NoStore bool
+}
+
+// storedHeaders are the origin response headers kept with a cached file and
+// sent along with it
+var storedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+}
+
+// statFromResponse builds a Stat out of the headers of an origin response to
+// a GET or HEAD request
+func statFromResponse(path string, res *http.Response) Stat {
+	stat := Stat{
+		Path:   path,
+		ETag:   res.Header.Get("ETag"),
+		Header: http.Header{},
+	}
+	for _, name := range storedHeaders {
+		if values, ok := res.Header[name]; ok {
+			stat.Header[name] = values
+		}
+	}
+	if res.ContentLength >= 0 {
+		stat.SizeInBytes = uint64(res.ContentLength)
+	}
+	lastModifiedAt, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	if err == nil {
+		stat.LastModifiedAt = lastModifiedAt
+	}
+	applyCacheHeaders(&stat, res.Header, time.Now())
+	return stat
+}
+
+// writeStoredHeader sets the stored origin headers of path on a response,
+// guessing Content-Type from the extension when origin sent none
+func writeStoredHeader(header http.Header, path string, stored http.Header) {
+	for name, values := range stored {
+		header[name] = values
+	}
+	if header.Get("Content-Type") == "" {
+		// without a guess leave it unset for http.ServeContent to sniff
+		if contentType := mime.TypeByExtension(pathLib.Ext(path)); contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+	}
+}
+
+// writeAge sets the Age of a cached copy last checked against origin at
+// validatedAt, so that clients and downstream caches count the max-age or
+// Expires origin gave from then rather than from now
+func writeAge(header http.Header, validatedAt time.Time) {
+	if validatedAt.IsZero() {
+		return
+	}
+	age := time.Since(validatedAt)
+	if age < 0 {
+		age = 0
+	}
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+}
+
+// newOriginHTTPClient returns the client S3 and HTTP origins are requested
+// with. A request fails, allowing stale copies to be served, when origin takes
+// longer than OriginConnectTimeoutInSeconds to accept the connection or
+// OriginHeaderTimeoutInSeconds to send the response headers.
+func newOriginHTTPClient(config Configuration) *http.Client {
+	connectTimeout := time.Duration(config.OriginConnectTimeoutInSeconds) * time.Second
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = time.Duration(config.OriginHeaderTimeoutInSeconds) * time.Second
+	// store what origin has as is, and keep GET and HEAD asking for the same
+	// encoding so that origins that compress give both the same ETag
+	transport.DisableCompression = true
+	return &http.Client{Transport: transport}
+}
+
+// checkResponse turns a failed origin request, or a response that is neither
+// 200 nor 206, into a StorageProviderError
+func checkResponse(res *http.Response, err error) (*http.Response, *StorageProviderError) {
+	if err != nil {
+		return nil, &StorageProviderError{http.StatusServiceUnavailable, err}
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		err = errors.New(fmt.Sprintf("status code: %d", res.StatusCode))
+		return nil, &StorageProviderError{res.StatusCode, err}
+	}
+	return res, nil
+}
+
+// readResponse writes the stat and body of an origin response to a GET
+// request for path to w
+func readResponse(path string, res *http.Response, w *CacheWriter) *StorageProviderError {
+	defer res.Body.Close()
+	w.WriteStat(statFromResponse(path, res))
+	w.WriteSize(res.ContentLength)
+	_, err := io.Copy(w, res.Body)
+	if err != nil {
+		return &StorageProviderError{http.StatusRequestTimeout, err}
+	}
+	return nil
+}
+
+// readRangeResponse is readResponse for range requests, which origin must
+// answer with 206 and bytes of version
+func readRangeResponse(path string, res *http.Response, version Stat, w *CacheWriter) *StorageProviderError {
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return &StorageProviderError{http.StatusBadGateway, errors.New("origin ignored range request")}
+	}
+	// origins may ignore If-Match, check the response too
+	etag := res.Header.Get("ETag")
+	contentRange := res.Header.Get("Content-Range")
+	total := contentRange[strings.LastIndex(contentRange, "/")+1:]
+	if (etag != "" && version.ETag != "" && etag != version.ETag) ||
+		(total != "" && total != "*" && total != strconv.FormatUint(version.SizeInBytes, 10)) {
+		res.Body.Close()
+		return &StorageProviderError{http.StatusPreconditionFailed, errors.New("file changed at origin")}
+	}
+	return readResponse(path, res, w)
+}
+
+// rangeHeader asks for length bytes from offset of version of a file, using
+// If-Match or, for origins without strong ETags, If-Unmodified-Since
+func rangeHeader(offset int64, length int64, version Stat) http.Header {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	if version.ETag != "" && !strings.HasPrefix(version.ETag, "W/") {
+		header.Set("If-Match", version.ETag)
+	} else if !version.LastModifiedAt.IsZero() {
+		header.Set("If-Unmodified-Since", version.LastModifiedAt.UTC().Format(http.TimeFormat))
+	}
+	return header
+}
+
+// changedSince tells whether the origin's stat differs from what was recorded
+// when the file was cached. ETags are preferred, falling back to comparing
+// modification times with localModifiedAt used when nothing was recorded.
+func (stat Stat) changedSince(record FileRecord, localModifiedAt time.Time) bool {
+	if stat.ETag != "" && record.ETag != "" {
+		// origins that compress on the fly weaken the ETag of what they compress
+		return strings.TrimPrefix(stat.ETag, "W/") != strings.TrimPrefix(record.ETag, "W/")
+	}
+	if stat.LastModifiedAt.IsZero() {
+		return false
+	}
+	if record.LastModifiedAt.IsZero() {
+		return stat.LastModifiedAt.After(localModifiedAt)
+	}
+	return stat.LastModifiedAt.After(record.LastModifiedAt)
 }
 
 type Cache struct {
-	db                        *leveldb.DB
+	db                        *Database
 	storageProvider           StorageProvider
 	cacheDir                  string
 	cacheSize                 uint64
@@ -73,9 +263,20 @@ type Cache struct {
 	bytesInUse                uint64
 	bytesUsedChan             chan int64
 	freeSpaceBatchSizeInBytes uint64
+	revalidateInterval        time.Duration
+	defaultTTLs               []DefaultTTL
+	staleWhileRevalidate      time.Duration
+	staleIfError              time.Duration
+	negativeTTL               time.Duration
+	sliceSize                 int64
+	sliceThreshold            uint64
 	bytesOut                  uint64
 	bytesIn                   uint64
 	startedAt                 time.Time
+	fillsMu                   sync.Mutex
+	fills                     map[string]*cacheFill
+	revalidating              map[string]bool      // guarded by fillsMu
+	stats                     map[string]*statCall // guarded by fillsMu
 }
 
 type CacheStats struct {
@@ -85,21 +286,13 @@ type CacheStats struct {
 	Uptime     int64
 }
 
-func (c *Cache) getStats() string {
-	cacheStats := CacheStats{
-		c.bytesInUse,
-		c.bytesOut,
-		c.bytesIn,
+func (c *Cache) getStats() CacheStats {
+	return CacheStats{
+		atomic.LoadUint64(&c.bytesInUse),
+		atomic.LoadUint64(&c.bytesOut),
+		atomic.LoadUint64(&c.bytesIn),
 		time.Now().Unix() - c.startedAt.Unix(),
 	}
-	stats, _ := json.Marshal(cacheStats)
-	return string(stats)
-}
-
-type CacheWriter struct {
-	client CacheClient
-	io.Writer
-	bytesWritten int64
 }
 
 type CacheClient struct {
@@ -107,108 +300,420 @@ type CacheClient struct {
 	req *http.Request
 }
 
-func (c *CacheWriter) WriteSize(sizeInBytes int64) {
-	c.client.Header().Set("Content-Length", strconv.FormatInt(sizeInBytes, 10))
-	c.bytesWritten = sizeInBytes
+// countingWriter adds the bytes written to a response to a counter
+type countingWriter struct {
+	http.ResponseWriter
+	count *uint64
 }
 
-func (c *Cache) Read(path string, lastModifiedAt time.Time, cacheClient CacheClient) *CacheError {
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddUint64(w.count, uint64(n))
+	return n, err
+}
+
+// cleanPath validates a client supplied path and trims it
+func cleanPath(path string) (string, *CacheError) {
 	pathParts := strings.Split(path, "/")
 	for _, elem := range pathParts {
-		if elem == "." || elem == ".." {
+		if elem == "." || elem == ".." || strings.HasSuffix(elem, sliceDirSuffix) {
 			err := errors.New("naughty path")
-			return &CacheError{http.StatusBadRequest, err}
+			return "", &CacheError{http.StatusBadRequest, err}
 		}
 	}
 	path = client.TrimPath(path)
 	if len(path) == 0 {
 		err := errors.New("Empty path")
-		return &CacheError{http.StatusBadRequest, err}
+		return "", &CacheError{http.StatusBadRequest, err}
 	}
+	return path, nil
+}
 
-	if path == "cacheStats" {
-		_, err := fmt.Fprint(cacheClient, c.getStats())
+func (c *Cache) Read(path string, lastModifiedAt time.Time, cacheClient CacheClient) *CacheError {
+	path, cacheError := cleanPath(path)
+	if cacheError != nil {
+		return cacheError
+	}
+
+	if c.negativeTTL > 0 {
+		record, missing, err := c.missingAtOrigin(path, lastModifiedAt)
 		if err != nil {
 			return &CacheError{http.StatusInternalServerError, err}
 		}
-		return nil
+		if missing {
+			cacheLookups.WithLabelValues(cacheNegative).Inc()
+			return &CacheError{record.Status, errors.New("missing at origin")}
+		}
 	}
+	cacheError = c.read(path, lastModifiedAt, cacheClient)
+	if cacheError != nil && c.negativeTTL > 0 &&
+		(cacheError.status == http.StatusNotFound || cacheError.status == http.StatusForbidden) {
+		now := time.Now()
+		err := PutMissingFile(c.db, path, MissingRecord{cacheError.status, now, now.Add(c.negativeTTL)})
+		if err != nil {
+			log.Printf("failed to remember %s as missing: %s", path, err)
+		}
+	}
+	return cacheError
+}
 
+// missingAtOrigin returns whether origin answered a request for path with a
+// 404 or 403 less than NegativeTTLInSeconds ago. A client asking for a copy
+// modified after that answer forgets it.
+func (c *Cache) missingAtOrigin(path string, lastModifiedAt time.Time) (MissingRecord, bool, error) {
+	record, found, err := GetMissingFile(c.db, path)
+	if err != nil || !found {
+		return record, false, err
+	}
+	if time.Now().Before(record.ExpiresAt) && !lastModifiedAt.After(record.CachedAt) {
+		return record, true, nil
+	}
+	_, err = DeleteMissingFile(c.db, path)
+	return record, false, err
+}
+
+// NegativeCacheWatchdog periodically deletes expired missing records, which
+// are otherwise only deleted when their path is requested again
+func (c *Cache) NegativeCacheWatchdog() {
+	for range time.Tick(c.negativeTTL) {
+		now := time.Now()
+		_, err := DeleteMissingFiles(c.db, "", func(record MissingRecord) bool {
+			return !now.Before(record.ExpiresAt)
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// read serves path from the cache, fetching it from origin if needed
+func (c *Cache) read(path string, lastModifiedAt time.Time, cacheClient CacheClient) *CacheError {
 	fullPath := c.buildCachePath(path)
 
 	stat, err := os.Stat(fullPath)
-	if err == nil && !stat.ModTime().Before(lastModifiedAt) {
-		file, err := os.Open(fullPath)
+	cached := err == nil
+	if cached {
+		// a file now served in slices may have left a whole copy behind
+		record, _, err := GetFile(c.db, path)
 		if err != nil {
 			return &CacheError{http.StatusInternalServerError, err}
 		}
-		defer file.Close()
-		err = PutFile(c.db, path)
-		if err != nil {
-			return &CacheError{http.StatusInternalServerError, err}
+		cached = !record.Sliced
+	}
+	fresh := false
+	var originStat *Stat
+	if cached {
+		var cacheError *CacheError
+		fresh, originStat, cacheError = c.revalidate(path, stat, !stat.ModTime().Before(lastModifiedAt))
+		if cacheError != nil {
+			return cacheError
 		}
-		c.bytesOut += uint64(stat.Size())
-		http.ServeContent(cacheClient, cacheClient.req, fullPath, stat.ModTime(), file)
-		return nil
+	}
+	if fresh {
+		return c.serveCached(path, cacheClient, false)
 	}
 
-	tmp, err := c.getTmpFile()
+	if c.sliceSize > 0 {
+		record, sliced, cacheError := c.sliceRecord(path, lastModifiedAt, originStat)
+		if cacheError != nil {
+			return cacheError
+		}
+		if sliced {
+			return c.serveSliced(path, record, cacheClient)
+		}
+	}
+
+	fill, file, err := c.joinFileFill(path)
 	if err != nil {
 		return &CacheError{http.StatusInternalServerError, err}
 	}
-	tmpName := tmp.Name()
-	tmpClosed := false
-	tmpRemoved := false
-	defer func() {
-		if !tmpClosed {
-			tmp.Close()
+	defer file.Close()
+	if cached {
+		storageProviderError := fill.waitStarted()
+		if storageProviderError != nil && storageProviderError.originFailed() && c.canServeStale(path) {
+			log.Printf("serving stale %s: %s", path, storageProviderError)
+			return c.serveCached(path, cacheClient, true)
 		}
-		if !tmpRemoved {
-			os.Remove(tmpName)
+	}
+	cacheLookups.WithLabelValues(cacheMiss).Inc()
+	return c.serveFill(fill, file, cacheClient)
+}
+
+// serveCached serves the cached copy of path, stale tells whether it is served
+// because origin failed to replace it
+func (c *Cache) serveCached(path string, cacheClient CacheClient, stale bool) *CacheError {
+	fullPath := c.buildCachePath(path)
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return &CacheError{http.StatusInternalServerError, err}
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return &CacheError{http.StatusInternalServerError, err}
+	}
+	record, _, err := GetFile(c.db, path)
+	if err != nil {
+		return &CacheError{http.StatusInternalServerError, err}
+	}
+	err = PutFile(c.db, path)
+	if err != nil {
+		return &CacheError{http.StatusInternalServerError, err}
+	}
+	if stale || record.expired(time.Now()) {
+		cacheLookups.WithLabelValues(cacheStale).Inc()
+	} else {
+		cacheLookups.WithLabelValues(cacheHit).Inc()
+	}
+	writeStoredHeader(cacheClient.Header(), path, record.Header)
+	writeAge(cacheClient.Header(), record.ValidatedAt)
+	modifiedAt := record.LastModifiedAt
+	if modifiedAt.IsZero() {
+		modifiedAt = stat.ModTime()
+	}
+	// count what is written, a range or a 304 sends less than the whole file
+	counted := countingWriter{cacheClient, &c.bytesOut}
+	http.ServeContent(counted, cacheClient.req, fullPath, modifiedAt, file)
+	return nil
+}
+
+// canServeStale reports whether the cached copy of path, which origin failed
+// to replace, expired less than StaleIfErrorInSeconds ago
+func (c *Cache) canServeStale(path string) bool {
+	if c.staleIfError == 0 {
+		return false
+	}
+	record, _, err := GetFile(c.db, path)
+	return err == nil && record.staleFor(time.Now()) < c.staleIfError
+}
+
+// joinFileFill joins or starts the fill of a whole file
+func (c *Cache) joinFileFill(path string) (*cacheFill, *os.File, error) {
+	return c.joinFill(path, func(w *CacheWriter) *StorageProviderError {
+		return c.storageProvider.Read(path, w)
+	})
+}
+
+// revalidate checks a cached file against origin when it expired or, if
+// revalidation is enabled, when it hasn't been checked for
+// revalidateInterval. Clients asking for a newer copy than the cached one
+// (fresh is false) can't trigger more checks than that, whatever modified they
+// send. Without revalidation such requests refetch the file. It returns
+// whether the cached copy can be served. Within the
+// StaleWhileRevalidateInSeconds window the check runs in the background and
+// the cached copy is served right away. The stat origin answered with, if it
+// was asked, is returned too.
+func (c *Cache) revalidate(path string, localStat os.FileInfo, fresh bool) (bool, *Stat, *CacheError) {
+	record, _, err := GetFile(c.db, path)
+	if err != nil {
+		return false, nil, &CacheError{http.StatusInternalServerError, err}
+	}
+	now := time.Now()
+	if !record.expired(now) {
+		if c.revalidateInterval == 0 {
+			return fresh, nil, nil
+		}
+		if now.Sub(record.ValidatedAt) < c.revalidateInterval {
+			return true, nil, nil
 		}
+	}
+	if fresh && record.staleFor(now) < c.staleWhileRevalidate {
+		c.revalidateInBackground(path, func() {
+			fresh, stat, _ := c.checkOrigin(path, record, localStat, true)
+			if fresh {
+				return
+			}
+			if stat != nil && c.sliceSize > 0 {
+				if _, sliced, _ := c.recordSlicedFile(path, record, false, *stat); sliced {
+					return
+				}
+			}
+			_, file, err := c.joinFileFill(path)
+			if err != nil {
+				log.Printf("failed to refresh %s: %s", path, err)
+				return
+			}
+			file.Close()
+		})
+		return true, nil, nil
+	}
+	return c.checkOrigin(path, record, localStat, fresh)
+}
+
+// revalidateInBackground runs revalidation in a goroutine unless path is
+// already being revalidated or fetched
+func (c *Cache) revalidateInBackground(path string, revalidation func()) {
+	c.fillsMu.Lock()
+	defer c.fillsMu.Unlock()
+	if c.revalidating[path] || c.fills[path] != nil {
+		return
+	}
+	c.revalidating[path] = true
+	go func() {
+		revalidation()
+		c.fillsMu.Lock()
+		delete(c.revalidating, path)
+		c.fillsMu.Unlock()
 	}()
+}
 
-	multiWriter := io.MultiWriter(tmp, cacheClient)
-	cacheWriter := CacheWriter{cacheClient, multiWriter, 0}
+// statCall is a Stat request to origin shared by every caller asking for the
+// same path while it runs
+type statCall struct {
+	done                 chan struct{}
+	stat                 Stat
+	storageProviderError *StorageProviderError
+}
 
-	cacheClient.Header().Set("Content-Type", mime.TypeByExtension(pathLib.Ext(fullPath)))
-	cacheClient.Header().Set("Accept-Ranges", "none")
+// statOrigin asks origin for the stat of path, joining the request already
+// running for path if there is one so that concurrent misses and
+// revalidations cost a single request
+func (c *Cache) statOrigin(path string) (Stat, *StorageProviderError) {
+	c.fillsMu.Lock()
+	call, ok := c.stats[path]
+	if ok {
+		c.fillsMu.Unlock()
+		<-call.done
+		return call.stat, call.storageProviderError
+	}
+	call = &statCall{done: make(chan struct{})}
+	c.stats[path] = call
+	c.fillsMu.Unlock()
+
+	call.stat, call.storageProviderError = c.storageProvider.Stat(path)
+	c.fillsMu.Lock()
+	delete(c.stats, path)
+	c.fillsMu.Unlock()
+	close(call.done)
+	return call.stat, call.storageProviderError
+}
 
-	storageProviderError := c.storageProvider.Read(path, &cacheWriter)
+// checkOrigin asks origin whether the cached copy of path described by record
+// changed. It returns whether the cached copy can be served, which when origin
+// fails is the case if it hasn't expired or expired less than
+// StaleIfErrorInSeconds ago, and origin's stat if it answered.
+func (c *Cache) checkOrigin(path string, record FileRecord, localStat os.FileInfo, fresh bool) (bool, *Stat, *CacheError) {
+	stat, storageProviderError := c.statOrigin(path)
 	if storageProviderError != nil {
-		return &CacheError{storageProviderError.status, storageProviderError}
+		if storageProviderError.status == http.StatusNotFound {
+			c.removeFile(path)
+			return false, nil, &CacheError{storageProviderError.status, storageProviderError}
+		}
+		log.Printf("failed to revalidate %s: %s", path, storageProviderError)
+		now := time.Now()
+		return fresh && (!record.expired(now) || record.staleFor(now) < c.staleIfError), nil, nil
 	}
-	dirPath := pathLib.Dir(fullPath)
-	err = os.MkdirAll(dirPath, 0755)
+	if stat.NoStore {
+		c.removeFile(path)
+		return false, &stat, nil
+	}
+	if stat.changedSince(record, localStat.ModTime()) {
+		return false, &stat, nil
+	}
+	// origin confirmed the cached copy, bump its mtime so that the modified
+	// query parameter doesn't trigger another revalidation
+	now := time.Now()
+	err := os.Chtimes(c.buildCachePath(path), now, now)
 	if err != nil {
-		return &CacheError{http.StatusInternalServerError, err}
+		return false, nil, &CacheError{http.StatusInternalServerError, err}
+	}
+	if stat.ETag == "" {
+		stat.ETag = record.ETag
+	}
+	if stat.LastModifiedAt.IsZero() {
+		stat.LastModifiedAt = record.LastModifiedAt
 	}
-	tmpClosed = true
-	err = tmp.Close()
+	if len(stat.Header) == 0 {
+		stat.Header = record.Header
+	}
+	c.applyDefaultTTL(&stat)
+	err = PutFileStat(c.db, path, stat)
 	if err != nil {
-		return &CacheError{http.StatusInternalServerError, err}
+		return false, nil, &CacheError{http.StatusInternalServerError, err}
 	}
+	return true, &stat, nil
+}
 
-	err = os.Chmod(tmpName, 0644)
-	if err != nil {
-		return &CacheError{http.StatusInternalServerError, err}
+// removeFile deletes a cached file from disk and from the database. It
+// returns whether the file was in the database and the bytes freed on disk.
+func (c *Cache) removeFile(path string) (found bool, sizeInBytes int64) {
+	found, _ = HasFile(c.db, path)
+	fullPath := c.buildCachePath(path)
+	stat, err := os.Stat(fullPath)
+	if err == nil && !stat.IsDir() && os.Remove(fullPath) == nil {
+		sizeInBytes = stat.Size()
+		// only files with a record were counted in bytesInUse
+		if found {
+			c.bytesUsedChan <- -sizeInBytes
+		}
 	}
+	DeleteFile(c.db, path)
+	return
+}
+
+type PurgeStats struct {
+	Purged     int
+	BytesFreed int64
+}
 
-	err = os.Rename(tmpName, fullPath)
+// Purge removes path, along with its slices, from the cache. If prefix is
+// true every path starting with path is removed. Running fills of purged paths
+// are discarded once done.
+func (c *Cache) Purge(path string, prefix bool) (stats PurgeStats, cacheError *CacheError) {
+	keepSlash := prefix && strings.HasSuffix(path, "/")
+	path, cacheError = cleanPath(path)
+	if cacheError != nil {
+		return
+	}
+	if keepSlash {
+		// the trailing slash tells prefix "a/" from prefix "a"
+		path += "/"
+	}
+
+	var paths []string
+	var err error
+	if prefix {
+		paths, err = ListPathsWithPrefix(c.db, path)
+	} else {
+		paths, err = ListPathsWithPrefix(c.db, path+sliceDirSuffix+"/")
+		paths = append(paths, path)
+	}
 	if err != nil {
-		return &CacheError{http.StatusInternalServerError, err}
+		return stats, &CacheError{http.StatusInternalServerError, err}
 	}
-	tmpRemoved = true
 
-	err = PutFile(c.db, path)
+	c.fillsMu.Lock()
+	for fillPath, f := range c.fills {
+		if fillPath == path || strings.HasPrefix(fillPath, path+sliceDirSuffix+"/") ||
+			(prefix && strings.HasPrefix(fillPath, path)) {
+			c.forgetFill(f)
+		}
+	}
+	c.fillsMu.Unlock()
+
+	for _, path := range paths {
+		found, size := c.removeFile(path)
+		if found {
+			stats.Purged++
+			stats.BytesFreed += size
+		}
+	}
+
+	var missing int
+	if prefix {
+		missing, err = DeleteMissingFiles(c.db, path, func(MissingRecord) bool { return true })
+	} else {
+		var found bool
+		found, err = DeleteMissingFile(c.db, path)
+		if found {
+			missing = 1
+		}
+	}
 	if err != nil {
-		return &CacheError{http.StatusInternalServerError, err}
+		return stats, &CacheError{http.StatusInternalServerError, err}
 	}
-	sizeInBytes := cacheWriter.bytesWritten
-	c.bytesOut += uint64(sizeInBytes)
-	c.bytesIn += uint64(sizeInBytes)
-	c.bytesUsedChan <- sizeInBytes
-	return nil
+	stats.Purged += missing
+	return
 }
 
 func (c *Cache) buildCachePath(path string) string {
@@ -217,43 +722,61 @@ func (c *Cache) buildCachePath(path string) string {
 
 func (c *Cache) FreeSpaceWatchdog() {
 	for size := range c.bytesUsedChan {
-		c.bytesInUse += uint64(size)
-		if c.bytesInUse > c.cacheSize {
-			c.freeSpace()
+		cacheSize := atomic.LoadUint64(&c.cacheSize)
+		if atomic.AddUint64(&c.bytesInUse, uint64(size)) > cacheSize {
+			c.freeSpace(cacheSize)
 		}
 	}
 }
 
-func (c *Cache) freeSpace() {
-	paths, err := ListPathsByModificationTime(c.db)
-	if err != nil {
-		log.Fatal(err)
-	}
-	bytesLeftToRemove := (c.bytesInUse - c.cacheSize) + c.freeSpaceBatchSizeInBytes
-	for _, path := range paths {
-		if bytesLeftToRemove <= 0 {
-			break
+// Resize changes the maximum size of the cache and how much is freed at once
+// when it is full, freeing space right away if needed
+func (c *Cache) Resize(cacheSize uint64, freeSpaceBatchSizeInBytes uint64) {
+	atomic.StoreUint64(&c.cacheSize, cacheSize)
+	atomic.StoreUint64(&c.freeSpaceBatchSizeInBytes, freeSpaceBatchSizeInBytes)
+	c.bytesUsedChan <- 0
+}
+
+func (c *Cache) freeSpace(cacheSize uint64) {
+	startedAt := time.Now()
+	defer func() {
+		evictionDuration.Observe(time.Since(startedAt).Seconds())
+	}()
+	bytesLeftToRemove := (atomic.LoadUint64(&c.bytesInUse) - cacheSize) + atomic.LoadUint64(&c.freeSpaceBatchSizeInBytes)
+	err := WalkPathsByEvictionOrder(c.db, func(path string, record FileRecord) bool {
+		if record.Sliced {
+			// only the slices take up space
+			EvictFile(c.db, path, record)
+			return true
 		}
 		fullPath := c.buildCachePath(path)
 		stat, err := os.Stat(fullPath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				DeleteFile(c.db, path)
-				log.Println(path + "no longer exists, deleting from db")
+				log.Println(path + " no longer exists, deleting from db")
 			} else {
 				log.Println(err)
 			}
-			continue
+			return true
 		}
 		size := uint64(stat.Size())
 		err = os.Remove(fullPath)
 		if err != nil {
 			log.Println("failed to delete " + path)
-			continue
+			return true
+		}
+		EvictFile(c.db, path, record)
+		evictions.Inc()
+		atomic.AddUint64(&c.bytesInUse, -size)
+		if size >= bytesLeftToRemove {
+			return false
 		}
-		DeleteFile(c.db, path)
-		c.bytesInUse -= size
 		bytesLeftToRemove -= size
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -262,7 +785,7 @@ func (c *Cache) getTmpFile() (file *os.File, err error) {
 	return
 }
 
-func GetCache(config Configuration, db *leveldb.DB, storageProvider StorageProvider) (cache *Cache, err error) {
+func GetCache(config Configuration, db *Database, storageProvider StorageProvider) (cache *Cache, err error) {
 	stat, err := os.Stat(config.CacheDir)
 	if err != nil {
 		return
@@ -278,6 +801,11 @@ func GetCache(config Configuration, db *leveldb.DB, storageProvider StorageProvi
 		err = errors.New("invalid tmp dir")
 	}
 
+	sliceThreshold := config.SliceThresholdInBytes
+	if sliceThreshold == 0 {
+		sliceThreshold = config.SliceSizeInBytes
+	}
+
 	bytesInUse := uint64(0)
 
 	err = filepath.Walk(config.CacheDir, func(path string, f os.FileInfo, err error) error {
@@ -307,14 +835,24 @@ func GetCache(config Configuration, db *leveldb.DB, storageProvider StorageProvi
 
 	cache = &Cache{
 		db:                        db,
-		storageProvider:           storageProvider,
+		storageProvider:           instrumentStorageProvider(storageProvider),
 		cacheDir:                  config.CacheDir,
 		cacheSize:                 config.CacheSize,
 		tmpDir:                    config.TmpDir,
 		bytesInUse:                bytesInUse,
 		bytesUsedChan:             make(chan int64, 1000),
 		freeSpaceBatchSizeInBytes: config.FreeSpaceBatchSizeInBytes,
+		revalidateInterval:        time.Duration(config.RevalidateIntervalInSeconds) * time.Second,
+		defaultTTLs:               config.DefaultTTLs,
+		staleWhileRevalidate:      time.Duration(config.StaleWhileRevalidateInSeconds) * time.Second,
+		staleIfError:              time.Duration(config.StaleIfErrorInSeconds) * time.Second,
+		negativeTTL:               time.Duration(config.NegativeTTLInSeconds) * time.Second,
+		sliceSize:                 int64(config.SliceSizeInBytes),
+		sliceThreshold:            sliceThreshold,
 		startedAt:                 time.Now(),
+		fills:                     make(map[string]*cacheFill),
+		revalidating:              make(map[string]bool),
+		stats:                     make(map[string]*statCall),
 	}
 	return
 }
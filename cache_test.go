@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubFile is a file served by stubProvider
+type stubFile struct {
+	body   string
+	etag   string
+	header http.Header // origin headers, Cache-Control and Expires set its expiry
+	// status, if set, is what origin answers instead of the file
+	status int
+	// statStatus, if set, is what origin answers to Stat, e.g. 405 for origins
+	// that don't allow HEAD
+	statStatus int
+	// failStatus, if set, makes Read fail with it after writing half the body
+	failStatus int
+}
+
+// stubProvider is a StorageProvider serving files from memory and counting
+// the requests it gets. A Read writes half of the file, then signals halfway
+// and waits on resume, if they are set, before writing the rest.
+type stubProvider struct {
+	mu      sync.Mutex
+	files   map[string]stubFile
+	calls   map[string]int // by "Read path", "ReadRange path" and "Stat path"
+	halfway chan string
+	resume  chan struct{}
+}
+
+func newStubProvider(files map[string]stubFile) *stubProvider {
+	return &stubProvider{files: files, calls: make(map[string]int)}
+}
+
+// gate makes reads stop halfway until the returned function is called
+func (p *stubProvider) gate() (halfway chan string, resume func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.halfway = make(chan string, 100)
+	p.resume = make(chan struct{})
+	return p.halfway, func() { close(p.resume) }
+}
+
+func (p *stubProvider) setFile(path string, file stubFile) {
+	p.mu.Lock()
+	p.files[path] = file
+	p.mu.Unlock()
+}
+
+func (p *stubProvider) count(call string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[call]
+}
+
+func (p *stubProvider) file(call string, path string) (stubFile, *StorageProviderError) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls[call+" "+path]++
+	file, ok := p.files[path]
+	if !ok {
+		return file, &StorageProviderError{http.StatusNotFound, errors.New("no such file")}
+	}
+	if file.status != 0 {
+		return file, &StorageProviderError{file.status, fmt.Errorf("status code: %d", file.status)}
+	}
+	return file, nil
+}
+
+func (file stubFile) stat(path string) Stat {
+	stat := Stat{
+		Path:        path,
+		SizeInBytes: uint64(len(file.body)),
+		ETag:        file.etag,
+		Header:      http.Header{},
+	}
+	for name, values := range file.header {
+		stat.Header[name] = values
+	}
+	if file.etag != "" {
+		stat.Header.Set("ETag", file.etag)
+	}
+	if lastModifiedAt, err := http.ParseTime(file.header.Get("Last-Modified")); err == nil {
+		stat.LastModifiedAt = lastModifiedAt
+	}
+	applyCacheHeaders(&stat, file.header, time.Now())
+	return stat
+}
+
+func (p *stubProvider) Read(path string, w *CacheWriter) *StorageProviderError {
+	file, storageProviderError := p.file("Read", path)
+	if storageProviderError != nil {
+		return storageProviderError
+	}
+	w.WriteStat(file.stat(path))
+	w.WriteSize(int64(len(file.body)))
+	half := len(file.body) / 2
+	w.Write([]byte(file.body[:half]))
+	p.mu.Lock()
+	halfway, resume := p.halfway, p.resume
+	p.mu.Unlock()
+	if halfway != nil {
+		halfway <- path
+		<-resume
+	}
+	if file.failStatus != 0 {
+		return &StorageProviderError{file.failStatus, errors.New("origin went away")}
+	}
+	w.Write([]byte(file.body[half:]))
+	return nil
+}
+
+func (p *stubProvider) ReadRange(path string, offset int64, length int64, version Stat, w *CacheWriter) *StorageProviderError {
+	file, storageProviderError := p.file("ReadRange", path)
+	if storageProviderError != nil {
+		return storageProviderError
+	}
+	if version.ETag != file.etag || version.SizeInBytes != uint64(len(file.body)) {
+		return &StorageProviderError{http.StatusPreconditionFailed, errors.New("file changed")}
+	}
+	w.WriteStat(file.stat(path))
+	w.WriteSize(length)
+	w.Write([]byte(file.body[offset : offset+length]))
+	return nil
+}
+
+func (p *stubProvider) Stat(path string) (Stat, *StorageProviderError) {
+	file, storageProviderError := p.file("Stat", path)
+	if storageProviderError != nil {
+		return Stat{}, storageProviderError
+	}
+	if file.statStatus != 0 {
+		return Stat{}, &StorageProviderError{file.statStatus, fmt.Errorf("status code: %d", file.statStatus)}
+	}
+	return file.stat(path), nil
+}
+
+// newTestCache returns a cache of provider in temporary directories. Only the
+// directories and database of config are set.
+func newTestCache(t *testing.T, config Configuration, provider StorageProvider) *Cache {
+	config.CacheDir = t.TempDir()
+	config.TmpDir = t.TempDir()
+	if config.CacheSize == 0 {
+		config.CacheSize = 1 << 30
+	}
+	db, err := GetDatabase(t.TempDir(), LRUPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	cache, err := GetCache(config, db, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cache.FreeSpaceWatchdog()
+	return cache
+}
+
+// get requests path from cache with modified 0 and the given request headers
+func get(c *Cache, path string, header http.Header) (*httptest.ResponseRecorder, *CacheError) {
+	return getModified(c, path, time.Unix(0, 0), header)
+}
+
+func getModified(c *Cache, path string, lastModifiedAt time.Time, header http.Header) (*httptest.ResponseRecorder, *CacheError) {
+	r := httptest.NewRequest("GET", "/"+path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	return w, c.Read(path, lastModifiedAt, CacheClient{w, r})
+}
+
+// runningFill returns the fill of path, which must be running
+func runningFill(t *testing.T, c *Cache, path string) *cacheFill {
+	c.fillsMu.Lock()
+	defer c.fillsMu.Unlock()
+	f := c.fills[path]
+	if f == nil {
+		t.Fatalf("no fill of %s", path)
+	}
+	return f
+}
+
+// checkCached fails unless path is cached whole with body, or not cached at
+// all, neither on disk nor in the database, if body is empty
+func checkCached(t *testing.T, c *Cache, path string, body string) {
+	t.Helper()
+	content, err := os.ReadFile(c.buildCachePath(path))
+	found, dbErr := HasFile(c.db, path)
+	if dbErr != nil {
+		t.Fatal(dbErr)
+	}
+	if body == "" {
+		if err == nil || found {
+			t.Errorf("%s is cached (on disk: %v, in the database: %v)", path, err == nil, found)
+		}
+		return
+	}
+	if err != nil || string(content) != body || !found {
+		t.Errorf("%s: got %q on disk (%v) and a record: %v, want %q", path, content, err, found, body)
+	}
+}
+
+// expire makes the cached copy of path expire ago
+func expire(t *testing.T, c *Cache, path string, ago time.Duration) {
+	t.Helper()
+	_, err := updateFile(c.db, path, func(record *FileRecord) {
+		record.ExpiresAt = time.Now().Add(-ago)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitRevalidated waits for background revalidations of path to finish
+func waitRevalidated(c *Cache, path string) {
+	for {
+		c.fillsMu.Lock()
+		revalidating := c.revalidating[path]
+		c.fillsMu.Unlock()
+		if !revalidating {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	tests := []struct {
+		name         string
+		staleFor     time.Duration
+		originStatus int // what origin answers once the copy is stale
+		status       int // 0 if the stale copy is served
+	}{
+		{"origin fine within stale-while-revalidate", 10 * time.Second, 0, 0},
+		{"origin failing within stale-while-revalidate", 10 * time.Second, http.StatusBadGateway, 0},
+		{"origin fine after stale-while-revalidate", 100 * time.Second, 0, 0},
+		{"origin failing within stale-if-error", 100 * time.Second, http.StatusBadGateway, 0},
+		{"origin unavailable within stale-if-error", 100 * time.Second, http.StatusServiceUnavailable, 0},
+		{"origin failing after stale-if-error", 400 * time.Second, http.StatusBadGateway, http.StatusBadGateway},
+		{"404 within stale-if-error", 100 * time.Second, http.StatusNotFound, http.StatusNotFound},
+		{"404 after stale-if-error", 400 * time.Second, http.StatusNotFound, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		provider := newStubProvider(map[string]stubFile{"a/file": {body: "cached", etag: `"v1"`}})
+		c := newTestCache(t, Configuration{StaleWhileRevalidateInSeconds: 60, StaleIfErrorInSeconds: 300}, provider)
+		if _, cacheError := get(c, "a/file", nil); cacheError != nil {
+			t.Fatal(cacheError)
+		}
+		expire(t, c, "a/file", test.staleFor)
+		provider.setFile("a/file", stubFile{body: "cached", etag: `"v1"`, status: test.originStatus})
+
+		w, cacheError := get(c, "a/file", nil)
+		waitRevalidated(c, "a/file")
+		status := 0
+		if cacheError != nil {
+			status = cacheError.status
+		}
+		if status != test.status {
+			t.Errorf("%s: got %d (%v), want %d", test.name, status, cacheError, test.status)
+			continue
+		}
+		if status == 0 && w.Body.String() != "cached" {
+			t.Errorf("%s: got %q, want \"cached\"", test.name, w.Body.String())
+		}
+		if test.originStatus == http.StatusNotFound {
+			checkCached(t, c, "a/file", "")
+		}
+	}
+}
+
+func TestStaleWhileRevalidateInBackground(t *testing.T) {
+	provider := newStubProvider(map[string]stubFile{"a/file": {body: "version 1", etag: `"v1"`}})
+	c := newTestCache(t, Configuration{StaleWhileRevalidateInSeconds: 60}, provider)
+	if _, cacheError := get(c, "a/file", nil); cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	expire(t, c, "a/file", 10*time.Second)
+	provider.setFile("a/file", stubFile{body: "version 2", etag: `"v2"`})
+	halfway, resume := provider.gate()
+
+	// the stale copy is served while a single revalidation refetches the file
+	for i := 0; i < 3; i++ {
+		w, cacheError := get(c, "a/file", nil)
+		if cacheError != nil {
+			t.Fatal(cacheError)
+		}
+		if w.Body.String() != "version 1" {
+			t.Errorf("got %q, want \"version 1\"", w.Body.String())
+		}
+		if i == 0 {
+			<-halfway
+		}
+	}
+	f := runningFill(t, c, "a/file")
+	if n := provider.count("Stat a/file"); n != 1 {
+		t.Errorf("origin got %d stats, want 1", n)
+	}
+	resume()
+	if f.waitDone() != nil {
+		t.Fatal("fill failed")
+	}
+	w, cacheError := get(c, "a/file", nil)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != "version 2" {
+		t.Errorf("got %q, want \"version 2\"", w.Body.String())
+	}
+	if n := provider.count("Read a/file"); n != 2 {
+		t.Errorf("origin got %d reads, want 2", n)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	provider := newStubProvider(map[string]stubFile{"a/forbidden": {status: http.StatusForbidden}})
+	c := newTestCache(t, Configuration{NegativeTTLInSeconds: 60}, provider)
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"a/missing", http.StatusNotFound},
+		{"a/forbidden", http.StatusForbidden},
+	} {
+		for i := 0; i < 3; i++ {
+			_, cacheError := get(c, test.path, nil)
+			if cacheError == nil || cacheError.status != test.status {
+				t.Fatalf("%s: got %v, want a %d error", test.path, cacheError, test.status)
+			}
+		}
+		if n := provider.count("Read " + test.path); n != 1 {
+			t.Errorf("%s: origin got %d reads, want 1", test.path, n)
+		}
+	}
+
+	// a client asking for a copy modified after the 404 goes to origin
+	record, found, err := GetMissingFile(c.db, "a/missing")
+	if err != nil || !found {
+		t.Fatalf("404 not remembered (%v)", err)
+	}
+	_, cacheError := getModified(c, "a/missing", record.CachedAt.Add(time.Second), nil)
+	if cacheError == nil || cacheError.status != http.StatusNotFound {
+		t.Fatalf("got %v, want a 404 error", cacheError)
+	}
+	if n := provider.count("Read a/missing"); n != 2 {
+		t.Errorf("origin got %d reads, want 2", n)
+	}
+
+	// once expired, the 404 is forgotten
+	err = PutMissingFile(c.db, "a/missing", MissingRecord{http.StatusNotFound, time.Now().Add(-2 * time.Minute), time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.setFile("a/missing", stubFile{body: "found"})
+	w, cacheError := get(c, "a/missing", nil)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != "found" {
+		t.Errorf("got %q, want \"found\"", w.Body.String())
+	}
+	if _, found, _ := GetMissingFile(c.db, "a/missing"); found {
+		t.Error("expired 404 kept")
+	}
+}
+
+func TestNegativeCacheClearedByFill(t *testing.T) {
+	provider := newStubProvider(map[string]stubFile{"a/file": {body: "found"}})
+	c := newTestCache(t, Configuration{NegativeTTLInSeconds: 60}, provider)
+	halfway, resume := provider.gate()
+	done := make(chan *CacheError)
+	go func() {
+		_, cacheError := get(c, "a/file", nil)
+		done <- cacheError
+	}()
+	<-halfway
+	f := runningFill(t, c, "a/file")
+	// a 404 for an older version remembered while the file is fetched
+	now := time.Now()
+	err := PutMissingFile(c.db, "a/file", MissingRecord{http.StatusNotFound, now, now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume()
+	if cacheError := <-done; cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if f.waitDone() != nil {
+		t.Fatal("fill failed")
+	}
+	if _, found, _ := GetMissingFile(c.db, "a/file"); found {
+		t.Error("404 kept after a successful fill")
+	}
+	w, cacheError := get(c, "a/file", nil)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != "found" {
+		t.Errorf("got %q, want \"found\"", w.Body.String())
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var adminUrl, token, prefix, pathsFile, certFile, keyFile, caFile string
+
+func init() {
+	flag.StringVar(&adminUrl, "adminurl", "", "adminurl, e.g. http://127.0.0.1:8081")
+	flag.StringVar(&token, "token", "", "admin token, defaults to $POORMANSCDN_ADMIN_TOKEN")
+	flag.StringVar(&prefix, "prefix", "", "prewarm every file under this prefix")
+	flag.StringVar(&pathsFile, "paths", "", "file with one path per line to prewarm, - for stdin")
+	flag.StringVar(&certFile, "cert", "", "client certificate for admin listeners requiring one")
+	flag.StringVar(&keyFile, "key", "", "key of the client certificate")
+	flag.StringVar(&caFile, "cacert", "", "CA certificate to verify the admin listener with")
+}
+
+type prewarmProgress struct {
+	Path   string
+	Status int
+	Error  string
+	Done   *int
+	Failed *int
+}
+
+func readPaths(r io.Reader) (paths []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		path := strings.TrimSpace(scanner.Text())
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// httpClient returns a client presenting the certificate given with -cert
+// and trusting the CA given with -cacert
+func httpClient() (*http.Client, error) {
+	if certFile == "" && caFile == "" {
+		return http.DefaultClient, nil
+	}
+	tlsConfig := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + caFile)
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+func main() {
+	flag.Parse()
+	if token == "" {
+		token = os.Getenv("POORMANSCDN_ADMIN_TOKEN")
+	}
+	if adminUrl == "" || (token == "" && certFile == "") {
+		log.Fatal("adminurl and token or cert are mandatory")
+	}
+	client, err := httpClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths := flag.Args()
+	if pathsFile != "" {
+		r := os.Stdin
+		if pathsFile != "-" {
+			file, err := os.Open(pathsFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			r = file
+		}
+		filePaths, err := readPaths(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		paths = append(paths, filePaths...)
+	}
+	if len(paths) == 0 && prefix == "" {
+		log.Fatal("nothing to prewarm, pass paths or prefix")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"Paths": paths, "Prefix": prefix})
+	if err != nil {
+		log.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(adminUrl, "/")+"/prewarm", bytes.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(res.Body)
+		log.Fatalf("prewarm failed: %s", bytes.TrimSpace(message))
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	n := 0
+	for {
+		var progress prewarmProgress
+		err := decoder.Decode(&progress)
+		if err == io.EOF {
+			log.Fatal("prewarm interrupted")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if progress.Done != nil {
+			fmt.Printf("%d done, %d failed\n", *progress.Done, *progress.Failed)
+			if *progress.Failed > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+		n++
+		if progress.Error != "" {
+			fmt.Printf("[%d] %d %s: %s\n", n, progress.Status, progress.Path, progress.Error)
+		} else {
+			fmt.Printf("[%d] %d %s\n", n, progress.Status, progress.Path)
+		}
+	}
+}
@@ -26,13 +26,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"time"
 
 	"github.com/alexandres/poormanscdn/client"
 )
 
-var path, cdnUrl, domain, host, secret string
+var path, prefix, cdnUrl, domain, host, kid, secret string
 var modified, expires int64
+var cookie bool
 
 func init() {
 	flag.StringVar(&cdnUrl, "cdnurl", "", "cdnurl")
@@ -41,12 +43,19 @@ func init() {
 	flag.Int64Var(&modified, "modified", 0, "modified")
 	flag.Int64Var(&expires, "expires", 0, "expires")
 	flag.StringVar(&path, "path", "", "path")
+	flag.StringVar(&prefix, "prefix", "", "sign every path under prefix, e.g. videos/123/")
 	flag.StringVar(&secret, "secret", "", "secret")
+	flag.StringVar(&kid, "kid", "", "id of the signing key secret belongs to")
+	flag.BoolVar(&cookie, "cookie", false, "print a Set-Cookie header instead of a URL")
 }
 
 func main() {
 	flag.Parse()
-	if cdnUrl == "" || path == "" || secret == "" {
+	if cookie {
+		if (path == "" && prefix == "") || secret == "" {
+			log.Fatal("path or prefix, and secret are mandatory")
+		}
+	} else if cdnUrl == "" || path == "" || secret == "" {
 		log.Fatal("cdnurl, path, and secret are mandatory")
 	}
 	var lastModifiedAt *time.Time
@@ -59,7 +68,27 @@ func main() {
 		expiresAtTime := time.Unix(expires, 0)
 		expiresAt = &expiresAtTime
 	}
-	url, err := client.GetSignedUrl(secret, cdnUrl, path, host, domain, lastModifiedAt, expiresAt)
+	if cookie {
+		var signedCookie *http.Cookie
+		if prefix != "" {
+			var err error
+			signedCookie, err = client.GetSignedPrefixCookieWithKey(kid, secret, prefix, host, domain, lastModifiedAt, expiresAt)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			signedCookie = client.GetSignedCookieWithKey(kid, secret, path, host, domain, lastModifiedAt, expiresAt)
+		}
+		fmt.Print("Set-Cookie: " + signedCookie.String())
+		return
+	}
+	var url string
+	var err error
+	if prefix != "" {
+		url, err = client.GetSignedPrefixUrlWithKey(kid, secret, cdnUrl, prefix, path, host, domain, lastModifiedAt, expiresAt)
+	} else {
+		url, err = client.GetSignedUrlWithKey(kid, secret, cdnUrl, path, host, domain, lastModifiedAt, expiresAt)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -19,18 +19,60 @@
 # CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 import hashlib
+import hmac
 import sys
 if sys.version_info >= (3,):
-    from urllib.parse import urlparse, urlencode, parse_qs
+    from urllib.parse import urlparse, urlencode, parse_qs, quote_plus
 else:
     from urlparse import parse_qs, urlparse
-    from urllib import urlencode
+    from urllib import urlencode, quote_plus
 
+SIG_V1 = "1"
+SIG_V2 = "2"
 
-def get_signed_url(secret, base_url, path, last_modified_at, expires_at, restrict_domain="", restrict_host=""):
-    parsed_base_url = urlparse(base_url) 
-    path = _trim_path(parsed_base_url.path) + "/" + _trim_path(path)
+
+def get_signed_url(secret, base_url, path, last_modified_at, expires_at, restrict_domain="", restrict_host="", kid=""):
+    return _get_signed_url(secret, base_url, path, "", last_modified_at, expires_at, restrict_domain, restrict_host, kid)
+
+def get_signed_prefix_url(secret, base_url, prefix, path, last_modified_at, expires_at, restrict_domain="", restrict_host="", kid=""):
+    # the signature allows any path under prefix, relative to base_url, to be
+    # downloaded with the same query
+    base_path = _trim_path(urlparse(base_url).path)
+    prefix = (base_path + "/" + prefix.lstrip(" /")).lstrip("/")
+    if prefix == base_path:
+        raise ValueError("missing prefix")
+    _check_prefix(prefix)
+    url = _get_signed_url(secret, base_url, path, prefix, last_modified_at, expires_at, restrict_domain, restrict_host, kid)
+    if not _trim_path(urlparse(url).path).startswith(prefix):
+        raise ValueError("path outside of prefix")
+    return url
+
+SIG_COOKIE_NAME = "pcdn_sig"
+
+def get_signed_cookie(secret, path, last_modified_at, expires_at, restrict_domain="", restrict_host="", kid="", prefix=""):
+    # returns the name, value and path of a cookie that signs downloads of
+    # path, or of every path under prefix if given, for pages that cannot add
+    # a query to every URL they load
+    path = _trim_path(path)
+    prefix = prefix.lstrip(" /")
+    if prefix:
+        _check_prefix(prefix)
+    q = {}
+    _sign_query(q, secret, path, prefix, last_modified_at, expires_at, restrict_domain, restrict_host, kid)
+    cookie = {"name": SIG_COOKIE_NAME, "value": urlencode(q), "path": "/" + (prefix or path)}
+    if expires_at:
+        cookie["expires"] = expires_at
+    return cookie
+
+def _get_signed_url(secret, base_url, path, prefix, last_modified_at, expires_at, restrict_domain, restrict_host, kid):
+    parsed_base_url = urlparse(base_url)
+    path = _trim_path(_trim_path(parsed_base_url.path) + "/" + _trim_path(path))
     q = parse_qs(parsed_base_url.query)
+    _sign_query(q, secret, path, prefix, last_modified_at, expires_at, restrict_domain, restrict_host, kid)
+    new_url = parsed_base_url._replace(path="/" + path, query=urlencode(q))
+    return new_url.geturl()
+
+def _sign_query(q, secret, path, prefix, last_modified_at, expires_at, restrict_domain, restrict_host, kid):
     q["host"] = restrict_host
     q["domain"] = restrict_domain
     modified_str = "0"
@@ -41,9 +83,19 @@ def get_signed_url(secret, base_url, path, last_modified_at, expires_at, restric
     if expires_at:
         expires_str = expires_at.strftime("%s")
     q["expires"] = expires_str
-    q["sig"] = _sign(secret, path, modified_str, expires_str, restrict_host, restrict_domain)
-    new_url = parsed_base_url._replace(path=path, query=urlencode(q))
-    return new_url.geturl()
+    if kid:
+        q["kid"] = kid
+    q["v"] = SIG_V2
+    if prefix:
+        q["prefix"] = prefix
+        q["sig"] = _sign_v2(secret, "prefix", prefix, modified_str, expires_str, restrict_host, restrict_domain)
+    else:
+        q["sig"] = _sign_v2(secret, "path", path, modified_str, expires_str, restrict_host, restrict_domain)
+
+def _check_prefix(prefix):
+    # without the trailing slash a signature of videos/1 would allow videos/10/ too
+    if not prefix.endswith("/"):
+        raise ValueError("prefix must end with /")
 
 def _trim_path(path):
     return path.strip(" /")
@@ -56,3 +108,19 @@ def _hash_string(s):
 def _sign(secret, path, modified, expires, host, domain):
     to_sign = "&".join([path, modified, expires, host, domain])
     return _hash_string(secret + _hash_string(to_sign))
+
+def _query_escape(s):
+    # same escaping as Go's url.QueryEscape
+    return quote_plus(s, safe="~")
+
+def _sign_v2(secret, resource, value, modified, expires, host, domain):
+    # resource is "path", or "prefix" for signatures of a whole prefix
+    to_sign = "&".join([
+        "v=" + SIG_V2,
+        resource + "=" + _query_escape(value),
+        "modified=" + _query_escape(modified),
+        "expires=" + _query_escape(expires),
+        "host=" + _query_escape(host),
+        "domain=" + _query_escape(domain),
+    ])
+    return hmac.new(secret.encode(), to_sign.encode(), hashlib.sha256).hexdigest()
@@ -0,0 +1,52 @@
+# Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+# Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+#
+# Permission is hereby granted, free of charge, to any person obtaining a copy of
+# this software and associated documentation files (the "Software"), to deal in
+# the Software without restriction, including without limitation the rights to
+# use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+# the Software, and to permit persons to whom the Software is furnished to do so,
+# subject to the following conditions:
+#
+# The above copyright notice and this permission notice shall be included in all
+# copies or substantial portions of the Software.
+#
+# THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+# IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+# FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+# COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+# IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+# CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+# Checks the signatures of the python client against client/testdata/signatures.json,
+# the vectors the Go client is tested against. Run with:
+#   python -m unittest discover client/python
+
+import io
+import json
+import os
+import sys
+import unittest
+
+sys.path.insert(0, os.path.dirname(os.path.abspath(__file__)))
+import poormanscdn
+
+VECTORS = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "testdata", "signatures.json")
+
+
+class SignatureVectorsTest(unittest.TestCase):
+    def setUp(self):
+        with io.open(VECTORS, encoding="utf-8") as f:
+            self.vectors = json.load(f)
+        self.assertTrue(self.vectors)
+
+    def test_signatures(self):
+        for i, v in enumerate(self.vectors):
+            fields = (v["Modified"], v["Expires"], v["Host"], v["Domain"])
+            self.assertEqual(poormanscdn._sign(v["Secret"], v["Path"], *fields), v["SigV1"], i)
+            self.assertEqual(poormanscdn._sign_v2(v["Secret"], "path", v["Path"], *fields), v["SigV2"], i)
+            self.assertEqual(poormanscdn._sign_v2(v["Secret"], "prefix", v["Path"], *fields), v["SigV2Prefix"], i)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -23,9 +23,14 @@
 package client
 
 import (
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
@@ -41,7 +46,75 @@ func TrimPath(path string) string {
 	return strings.Trim(path, " /")
 }
 
+// Signature versions, given in the v query parameter of signed URLs. URLs
+// without it are signed with SigV1.
+const (
+	SigV1 = "1"
+	SigV2 = "2"
+)
+
+// SigningKey is a secret named by the kid query parameter of the URLs it
+// signs, which allows several keys to be valid during a rotation. A
+// VerifyOnly key is still accepted but must not sign new URLs, so that it can
+// be removed once the URLs it signed have expired.
+type SigningKey struct {
+	ID         string
+	Secret     string
+	VerifyOnly bool
+}
+
+// FindKey returns the key named kid
+func FindKey(keys []SigningKey, kid string) (key SigningKey, ok bool) {
+	for _, key = range keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// CurrentKey returns the first key of keys that may sign new URLs
+func CurrentKey(keys []SigningKey) (key SigningKey, ok bool) {
+	for _, key = range keys {
+		if !key.VerifyOnly {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// VerifySig checks a SigV1 signature and the restrictions it covers
 func VerifySig(sig, secret, path, modified, expires, host, domain, userHost, referer string) (err error) {
+	return verifySig(sig, Sign(secret, path, modified, expires, host, domain), modified, expires, host, domain, userHost, referer)
+}
+
+// VerifySigV2 checks a SigV2 signature and the restrictions it covers
+func VerifySigV2(sig, secret, path, modified, expires, host, domain, userHost, referer string) (err error) {
+	return verifySig(sig, SignV2(secret, path, modified, expires, host, domain), modified, expires, host, domain, userHost, referer)
+}
+
+// VerifySigV2Prefix checks a SigV2 signature of prefix, made by SignV2Prefix,
+// for a request of path, which must start with prefix. prefix must end with a
+// slash, otherwise a signature of videos/1 would allow videos/10/ too.
+func VerifySigV2Prefix(sig, secret, prefix, path, modified, expires, host, domain, userHost, referer string) (err error) {
+	if prefix == "" {
+		return errors.New("missing prefix")
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		return errors.New("prefix must end with /")
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return errors.New("path outside of signed prefix")
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." {
+			return errors.New("bad path")
+		}
+	}
+	return verifySig(sig, SignV2Prefix(secret, prefix, modified, expires, host, domain), modified, expires, host, domain, userHost, referer)
+}
+
+func verifySig(sig, correctSig, modified, expires, host, domain, userHost, referer string) (err error) {
 	if modified == "" {
 		err = errors.New("missing modified")
 		return
@@ -68,7 +141,7 @@ func VerifySig(sig, secret, path, modified, expires, host, domain, userHost, ref
 		}
 	}
 	if host != "" {
-		if host != userHost {
+		if !hostAllowed(host, userHost) {
 			err = errors.New(fmt.Sprintf("only downloads from %s allowed, you are %s", host, userHost))
 			return
 		}
@@ -81,20 +154,106 @@ func VerifySig(sig, secret, path, modified, expires, host, domain, userHost, ref
 			return err
 		}
 	}
-	correctSig := Sign(secret, path, modified, expires, host, domain)
-	if correctSig != sig {
+	if !hmac.Equal([]byte(correctSig), []byte(sig)) {
 		err = errors.New("auth failed")
 		return err
 	}
 	return
 }
 
+// hostAllowed reports whether userHost is host, an IP address, or is within
+// host, a CIDR range such as 203.0.113.0/24 or 2001:db8::/32
+func hostAllowed(host, userHost string) bool {
+	userIP := net.ParseIP(userHost)
+	if _, hostNet, err := net.ParseCIDR(host); err == nil {
+		return userIP != nil && hostNet.Contains(userIP)
+	}
+	if hostIP := net.ParseIP(host); hostIP != nil && userIP != nil {
+		return hostIP.Equal(userIP)
+	}
+	return host == userHost
+}
+
+// Sign computes a SigV1 signature, sha1(secret + sha1(fields)). Use SignV2
+// for new URLs.
 func Sign(secret, path, modified, expires, host, domain string) string {
 	toSign := strings.Join([]string{path, modified, expires, host, domain}, "&")
 	return hashString(secret + hashString(toSign))
 }
 
+// SignV2 computes a SigV2 signature, the hex encoded HMAC-SHA256 keyed with
+// secret of the query escaped fields in a fixed order, e.g.
+// v=2&path=some%2Ffile.ext&modified=0&expires=&host=&domain=
+func SignV2(secret, path, modified, expires, host, domain string) string {
+	return signV2(secret, "path", path, modified, expires, host, domain)
+}
+
+// SignV2Prefix computes a SigV2 signature that is valid for every path under
+// prefix, e.g. videos/123/ for the segments of a stream. It signs the fields
+// like SignV2, with prefix=videos%2F123%2F in place of the path.
+func SignV2Prefix(secret, prefix, modified, expires, host, domain string) string {
+	return signV2(secret, "prefix", prefix, modified, expires, host, domain)
+}
+
+func signV2(secret, resource, value, modified, expires, host, domain string) string {
+	toSign := "v=" + SigV2 +
+		"&" + resource + "=" + url.QueryEscape(value) +
+		"&modified=" + url.QueryEscape(modified) +
+		"&expires=" + url.QueryEscape(expires) +
+		"&host=" + url.QueryEscape(host) +
+		"&domain=" + url.QueryEscape(domain)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(toSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GetSignedUrl returns a SigV2 signed URL for path under baseUrl
 func GetSignedUrl(secret string, baseUrl string, path string, host string,
+	domain string, modified *time.Time, expires *time.Time) (signedUrl string, err error) {
+	return getSignedUrl("", secret, baseUrl, path, "", host, domain, modified, expires)
+}
+
+// GetSignedUrlWithKey is GetSignedUrl for a secret from SigningKeys, kid is
+// the ID of the key and is added to the URL
+func GetSignedUrlWithKey(kid string, secret string, baseUrl string, path string, host string,
+	domain string, modified *time.Time, expires *time.Time) (signedUrl string, err error) {
+	return getSignedUrl(kid, secret, baseUrl, path, "", host, domain, modified, expires)
+}
+
+// GetSignedPrefixUrl returns a SigV2 signed URL for path under baseUrl whose
+// signature, carried along with prefix in the query, also allows any other
+// path under prefix to be downloaded with the same query
+func GetSignedPrefixUrl(secret string, baseUrl string, prefix string, path string, host string,
+	domain string, modified *time.Time, expires *time.Time) (signedUrl string, err error) {
+	return getSignedPrefixUrl("", secret, baseUrl, prefix, path, host, domain, modified, expires)
+}
+
+// GetSignedPrefixUrlWithKey is GetSignedPrefixUrl for a secret from
+// SigningKeys, kid is the ID of the key and is added to the URL
+func GetSignedPrefixUrlWithKey(kid string, secret string, baseUrl string, prefix string, path string, host string,
+	domain string, modified *time.Time, expires *time.Time) (signedUrl string, err error) {
+	return getSignedPrefixUrl(kid, secret, baseUrl, prefix, path, host, domain, modified, expires)
+}
+
+func getSignedPrefixUrl(kid string, secret string, baseUrl string, prefix string, path string, host string,
+	domain string, modified *time.Time, expires *time.Time) (signedUrl string, err error) {
+	prefix = strings.TrimLeft(prefix, " /")
+	if prefix == "" {
+		err = errors.New("missing prefix")
+		return
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		err = errors.New("prefix must end with /")
+		return
+	}
+	if !strings.HasPrefix(TrimPath(path), prefix) {
+		err = errors.New("path outside of prefix")
+		return
+	}
+	return getSignedUrl(kid, secret, baseUrl, path, prefix, host, domain, modified, expires)
+}
+
+func getSignedUrl(kid string, secret string, baseUrl string, path string, prefix string, host string,
 	domain string, modified *time.Time, expires *time.Time) (signedUrl string, err error) {
 	path = TrimPath(path)
 	parsedBaseUrl, err := url.Parse(baseUrl)
@@ -102,6 +261,83 @@ func GetSignedUrl(secret string, baseUrl string, path string, host string,
 		return
 	}
 	q := parsedBaseUrl.Query()
+	signQuery(q, kid, secret, path, prefix, host, domain, modified, expires)
+	newUrl := url.URL{
+		Scheme:   parsedBaseUrl.Scheme,
+		User:     parsedBaseUrl.User,
+		Host:     parsedBaseUrl.Host,
+		Path:     path,
+		RawQuery: q.Encode(),
+		Fragment: parsedBaseUrl.Fragment,
+	}
+	signedUrl = newUrl.String()
+	return
+}
+
+// SigCookieName is the cookie that signs requests whose URL has no sig. Its
+// value holds the same fields as a signed query.
+const SigCookieName = "pcdn_sig"
+
+// GetSignedCookie returns a cookie that signs downloads of path, for pages
+// that cannot add a query to every URL they load. Set its Domain if the
+// cookie is issued by another host than the CDN, e.g. mysite.com for a CDN
+// at cdn.mysite.com.
+func GetSignedCookie(secret string, path string, host string,
+	domain string, modified *time.Time, expires *time.Time) *http.Cookie {
+	return GetSignedCookieWithKey("", secret, path, host, domain, modified, expires)
+}
+
+// GetSignedCookieWithKey is GetSignedCookie for a secret from SigningKeys,
+// kid is the ID of the key and is added to the cookie
+func GetSignedCookieWithKey(kid string, secret string, path string, host string,
+	domain string, modified *time.Time, expires *time.Time) *http.Cookie {
+	path = TrimPath(path)
+	return signedCookie(kid, secret, path, "", host, domain, modified, expires)
+}
+
+// GetSignedPrefixCookie returns a cookie that signs downloads of every path
+// under prefix, e.g. the playlists and segments of a stream
+func GetSignedPrefixCookie(secret string, prefix string, host string,
+	domain string, modified *time.Time, expires *time.Time) (cookie *http.Cookie, err error) {
+	return GetSignedPrefixCookieWithKey("", secret, prefix, host, domain, modified, expires)
+}
+
+// GetSignedPrefixCookieWithKey is GetSignedPrefixCookie for a secret from
+// SigningKeys, kid is the ID of the key and is added to the cookie
+func GetSignedPrefixCookieWithKey(kid string, secret string, prefix string, host string,
+	domain string, modified *time.Time, expires *time.Time) (cookie *http.Cookie, err error) {
+	prefix = strings.TrimLeft(prefix, " /")
+	if prefix == "" {
+		err = errors.New("missing prefix")
+		return
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		err = errors.New("prefix must end with /")
+		return
+	}
+	return signedCookie(kid, secret, "", prefix, host, domain, modified, expires), nil
+}
+
+func signedCookie(kid string, secret string, path string, prefix string, host string,
+	domain string, modified *time.Time, expires *time.Time) *http.Cookie {
+	q := url.Values{}
+	signQuery(q, kid, secret, path, prefix, host, domain, modified, expires)
+	cookie := &http.Cookie{
+		Name:     SigCookieName,
+		Value:    q.Encode(),
+		Path:     "/" + path + prefix,
+		HttpOnly: true,
+	}
+	if expires != nil {
+		cookie.Expires = *expires
+	}
+	return cookie
+}
+
+// signQuery sets the fields of a SigV2 signature of path, or of prefix if it
+// is not empty, in q
+func signQuery(q url.Values, kid string, secret string, path string, prefix string, host string,
+	domain string, modified *time.Time, expires *time.Time) {
 	q.Set("host", host)
 	q.Set("domain", domain)
 	modifiedStr := "0"
@@ -114,15 +350,14 @@ func GetSignedUrl(secret string, baseUrl string, path string, host string,
 		expiresStr = strconv.FormatInt(expires.Unix(), 10)
 	}
 	q.Set("expires", expiresStr)
-	q.Set("sig", Sign(secret, path, modifiedStr, expiresStr, host, domain))
-	newUrl := url.URL{
-		Scheme:   parsedBaseUrl.Scheme,
-		User:     parsedBaseUrl.User,
-		Host:     parsedBaseUrl.Host,
-		Path:     path,
-		RawQuery: q.Encode(),
-		Fragment: parsedBaseUrl.Fragment,
+	if kid != "" {
+		q.Set("kid", kid)
+	}
+	q.Set("v", SigV2)
+	if prefix != "" {
+		q.Set("prefix", prefix)
+		q.Set("sig", SignV2Prefix(secret, prefix, modifiedStr, expiresStr, host, domain))
+	} else {
+		q.Set("sig", SignV2(secret, path, modifiedStr, expiresStr, host, domain))
 	}
-	signedUrl = newUrl.String()
-	return
 }
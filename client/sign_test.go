@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+// signatureVector is an entry of testdata/signatures.json, which the clients
+// in other languages check themselves against too
+type signatureVector struct {
+	Secret, Path, Modified, Expires, Host, Domain string
+	SigV1, SigV2, SigV2Prefix                     string
+}
+
+func loadSignatureVectors(t *testing.T) []signatureVector {
+	data, err := ioutil.ReadFile("testdata/signatures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []signatureVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no signature vectors")
+	}
+	return vectors
+}
+
+func TestSignatureVectors(t *testing.T) {
+	for i, v := range loadSignatureVectors(t) {
+		if sig := Sign(v.Secret, v.Path, v.Modified, v.Expires, v.Host, v.Domain); sig != v.SigV1 {
+			t.Errorf("%d: SigV1 of %q is %s, expected %s", i, v.Path, sig, v.SigV1)
+		}
+		if sig := SignV2(v.Secret, v.Path, v.Modified, v.Expires, v.Host, v.Domain); sig != v.SigV2 {
+			t.Errorf("%d: SigV2 of %q is %s, expected %s", i, v.Path, sig, v.SigV2)
+		}
+		if sig := SignV2Prefix(v.Secret, v.Path, v.Modified, v.Expires, v.Host, v.Domain); sig != v.SigV2Prefix {
+			t.Errorf("%d: SigV2Prefix of %q is %s, expected %s", i, v.Path, sig, v.SigV2Prefix)
+		}
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	tests := []struct {
+		host, userHost string
+		want           bool
+	}{
+		{"203.0.113.7", "203.0.113.7", true},
+		{"203.0.113.7", "203.0.113.8", false},
+		{"203.0.113.0/24", "203.0.113.200", true},
+		{"203.0.113.0/24", "203.0.114.1", false},
+		{"203.0.113.0/24", "not-an-ip", false},
+		{"203.0.113.0/24", "", false},
+		{"2001:db8::/32", "2001:db8:1::5", true},
+		{"2001:db8::/32", "2001:db9::5", false},
+		{"2001:db8::5", "2001:0db8:0000::5", true},
+		{"2001:db8::5", "2001:db8::6", false},
+		{"203.0.113.7", "::ffff:203.0.113.7", true},
+		{"::ffff:203.0.113.7", "203.0.113.7", true},
+		{"203.0.113.0/24", "::ffff:203.0.113.9", true},
+		{"::ffff:203.0.113.0/120", "203.0.113.9", true},
+		{"2001:db8::/32", "203.0.113.7", false},
+		{"203.0.113.0/24", "2001:db8::1", false},
+		{"localhost", "localhost", true},
+		{"localhost", "127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if got := hostAllowed(test.host, test.userHost); got != test.want {
+			t.Errorf("hostAllowed(%q, %q) = %v, want %v", test.host, test.userHost, got, test.want)
+		}
+	}
+}
+
+func TestSigningKeys(t *testing.T) {
+	keys := []SigningKey{
+		{ID: "old", Secret: "old-secret", VerifyOnly: true},
+		{ID: "new", Secret: "new-secret"},
+		{ID: "next", Secret: "next-secret"},
+	}
+	if key, ok := FindKey(keys, "gone"); ok {
+		t.Errorf("unknown kid found as %+v", key)
+	}
+	if key, ok := FindKey(keys, ""); ok {
+		t.Errorf("empty kid found as %+v", key)
+	}
+	key, ok := FindKey(keys, "old")
+	if !ok || key.Secret != "old-secret" {
+		t.Fatalf("got %+v %v for the verify only key", key, ok)
+	}
+	// a verify only key still verifies the URLs it signed
+	sig := SignV2(key.Secret, "a/file", "0", "", "", "")
+	if err := VerifySigV2(sig, key.Secret, "a/file", "0", "", "", "", "", ""); err != nil {
+		t.Errorf("verify only key: %s", err)
+	}
+	if err := VerifySigV2(sig, "new-secret", "a/file", "0", "", "", "", "", ""); err == nil {
+		t.Errorf("signature of the old key verified with the new one")
+	}
+	// but never signs new ones
+	if key, ok := CurrentKey(keys); !ok || key.ID != "new" {
+		t.Errorf("got current key %+v %v, want new", key, ok)
+	}
+	if key, ok := CurrentKey(keys[:1]); ok {
+		t.Errorf("got current key %+v with only a verify only key", key)
+	}
+	if key, ok := CurrentKey(nil); ok {
+		t.Errorf("got current key %+v without keys", key)
+	}
+}
+
+func TestVerifySigV2PrefixPaths(t *testing.T) {
+	tests := []struct {
+		name, prefix, path string
+		ok                 bool
+	}{
+		{"path under prefix", "a/", "a/file", true},
+		{"nested path under prefix", "a/", "a/b/file", true},
+		{"prefix without trailing slash", "a", "a/file", false},
+		{"sibling sharing a string prefix", "a/", "ab/file", false},
+		{"sibling directory", "a/", "ab/", false},
+		{"dot dot segment", "a/", "a/../b/file", false},
+		{"trailing dot dot segment", "a/", "a/b/..", false},
+		{"dot dot in a name", "a/", "a/..file", true},
+		{"empty prefix", "", "a/file", false},
+	}
+	for _, test := range tests {
+		// signed without the checks of the URL and cookie helpers
+		sig := SignV2Prefix("secret", test.prefix, "0", "", "", "")
+		err := VerifySigV2Prefix(sig, "secret", test.prefix, test.path, "0", "", "", "", "", "")
+		if (err == nil) != test.ok {
+			t.Errorf("%s: VerifySigV2Prefix(%q, %q) got error %v", test.name, test.prefix, test.path, err)
+		}
+	}
+	if _, err := GetSignedPrefixUrl("secret", "https://cdn.example.com", "a", "a/file", "", "", nil, nil); err == nil {
+		t.Errorf("prefix without trailing slash signed")
+	}
+	if _, err := GetSignedPrefixUrl("secret", "https://cdn.example.com", "a/", "ab/file", "", "", nil, nil); err == nil {
+		t.Errorf("path outside of prefix signed")
+	}
+}
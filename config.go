@@ -25,37 +25,327 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"os"
+	pathLib "path"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/alexandres/poormanscdn/client"
+)
+
+const (
+	StorageBackendS3         = "s3"
+	StorageBackendFilesystem = "filesystem"
+	StorageBackendHTTP       = "http"
+)
+
+const defaultPrewarmConcurrency = 4
+
+const (
+	defaultOriginConnectTimeoutInSeconds = 10
+	defaultOriginHeaderTimeoutInSeconds  = 30
 )
 
 type Configuration struct {
-	Listen                    string
-	S3Bucket                  string
-	S3AccessKey               string
-	S3SecretKey               string
-	TmpDir                    string
-	CacheDir                  string
-	CacheSize                 uint64
-	DatabaseDir               string
-	FreeSpaceBatchSizeInBytes uint64
-	Secret                    string
-	SigRequired               bool
-}
-
-func GetConfiguration(configPath string) (conf Configuration, err error) {
-	file, err := os.Open(configPath)
+	Listen                        string
+	TLSListen                     string
+	TLSCertFile                   string
+	TLSKeyFile                    string
+	ACMEHosts                     []string
+	ACMECacheDir                  string
+	ACMEEmail                     string
+	ACMEDirectoryURL              string
+	RedirectToHTTPS               bool
+	TrustedProxies                []string `reloadable:"true"`
+	ProxyProtocol                 bool
+	AdminListen                   string
+	AdminToken                    string `secret:"true" reloadable:"true"`
+	AdminTLSCertFile              string
+	AdminTLSKeyFile               string
+	AdminClientCAFile             string
+	PrewarmConcurrency            int `reloadable:"true"`
+	StorageBackend                string
+	S3Bucket                      string
+	S3AccessKey                   string
+	S3SecretKey                   string `secret:"true"`
+	S3Region                      string
+	S3Endpoint                    string
+	S3PathStyle                   bool
+	FilesystemRoot                string
+	OriginURL                     string
+	OriginHeaders                 map[string]string `secret:"true"`
+	OriginConnectTimeoutInSeconds int64
+	OriginHeaderTimeoutInSeconds  int64
+	TmpDir                        string
+	CacheDir                      string
+	CacheSize                     uint64 `reloadable:"true"`
+	DatabaseDir                   string
+	FreeSpaceBatchSizeInBytes     uint64 `reloadable:"true"`
+	EvictionPolicy                string
+	RevalidateIntervalInSeconds   int64
+	DefaultTTLs                   []DefaultTTL
+	StaleWhileRevalidateInSeconds int64
+	StaleIfErrorInSeconds         int64
+	NegativeTTLInSeconds          int64
+	SliceSizeInBytes              uint64
+	SliceThresholdInBytes         uint64
+	Secret                        string              `secret:"true" reloadable:"true"`
+	SigningKeys                   []client.SigningKey `secret:"true" reloadable:"true"`
+	SigRequired                   bool                `reloadable:"true"`
+	AllowSigV1                    bool                `reloadable:"true"`
+	AccessLogFile                 string              `reloadable:"true"`
+	ErrorLogFile                  string              `reloadable:"true"`
+}
+
+const (
+	defaultConfigPath = "config.json"
+	envPrefix         = "POORMANSCDN_"
+)
+
+// GetConfiguration reads the configuration file given by the -config flag,
+// the POORMANSCDN_CONFIG environment variable or else config.json, if it
+// exists, then overrides its fields with POORMANSCDN_* environment variables
+// and finally with command-line flags. A field such as S3AccessKey is set by
+// POORMANSCDN_S3_ACCESS_KEY and -s3-access-key.
+func GetConfiguration(args []string) (conf Configuration, err error) {
+	flags := flag.NewFlagSet("poormanscdn", flag.ContinueOnError)
+	configPath := flags.String("config", "", "configuration file, defaults to $"+envPrefix+"CONFIG or "+defaultConfigPath)
+	overrides := make(map[string]string)
+	fields := reflect.ValueOf(&conf).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		flags.Var(configFlag{field.Name, fields.Field(i).Kind() == reflect.Bool, overrides},
+			configName(field.Name, "-"), "overrides "+field.Name+", also set by $"+envPrefix+strings.ToUpper(configName(field.Name, "_")))
+	}
+	err = flags.Parse(args)
 	if err != nil {
 		return
 	}
-	decoder := json.NewDecoder(file)
-	conf = Configuration{}
-	err = decoder.Decode(&conf)
+
+	if *configPath == "" {
+		*configPath = os.Getenv(envPrefix + "CONFIG")
+	}
+	if *configPath != "" {
+		err = readConfigFile(*configPath, &conf)
+	} else {
+		err = readConfigFile(defaultConfigPath, &conf)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
 	if err != nil {
 		return
 	}
-	if conf.SigRequired && conf.Secret == "" {
-		err = errors.New("sig is required but no secret provided")
-		return
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Type().Field(i).Name
+		if value, ok := os.LookupEnv(envPrefix + strings.ToUpper(configName(name, "_"))); ok {
+			err = setConfigField(fields.Field(i), value)
+			if err != nil {
+				err = fmt.Errorf("bad value in $%s%s: %s", envPrefix, strings.ToUpper(configName(name, "_")), err)
+				return
+			}
+		}
+		if value, ok := overrides[name]; ok {
+			err = setConfigField(fields.Field(i), value)
+			if err != nil {
+				err = fmt.Errorf("bad value for -%s: %s", configName(name, "-"), err)
+				return
+			}
+		}
 	}
+
+	err = validateConfiguration(&conf)
 	return
 }
+
+// validateConfiguration checks that config is consistent and sets the
+// defaults of options left empty
+func validateConfiguration(config *Configuration) error {
+	switch config.StorageBackend {
+	case "":
+		config.StorageBackend = StorageBackendS3
+	case StorageBackendS3:
+	case StorageBackendFilesystem:
+		if config.FilesystemRoot == "" {
+			return errors.New("filesystem backend requires a filesystem root")
+		}
+	case StorageBackendHTTP:
+		if config.OriginURL == "" {
+			return errors.New("http backend requires an origin url")
+		}
+	default:
+		return errors.New("unknown storage backend " + config.StorageBackend)
+	}
+	for _, ttl := range config.DefaultTTLs {
+		if _, err := pathLib.Match(ttl.Pattern, ""); err != nil {
+			return errors.New("bad default ttl pattern " + ttl.Pattern)
+		}
+	}
+	if config.PrewarmConcurrency <= 0 {
+		config.PrewarmConcurrency = defaultPrewarmConcurrency
+	}
+	if config.OriginConnectTimeoutInSeconds <= 0 {
+		config.OriginConnectTimeoutInSeconds = defaultOriginConnectTimeoutInSeconds
+	}
+	if config.OriginHeaderTimeoutInSeconds <= 0 {
+		config.OriginHeaderTimeoutInSeconds = defaultOriginHeaderTimeoutInSeconds
+	}
+	if config.TLSListen != "" && config.TLSCertFile == "" && len(config.ACMEHosts) == 0 {
+		return errors.New("tls listener requires a certificate or acme hosts")
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return errors.New("tls requires both a certificate and a key")
+	}
+	if config.TLSCertFile != "" && len(config.ACMEHosts) > 0 {
+		return errors.New("tls takes either a certificate or acme hosts, not both")
+	}
+	if len(config.ACMEHosts) > 0 && config.ACMECacheDir == "" {
+		return errors.New("acme requires a cache dir")
+	}
+	if config.RedirectToHTTPS && config.TLSListen == "" {
+		return errors.New("redirecting to https requires a tls listener")
+	}
+	if _, err := parseNets(config.TrustedProxies); err != nil {
+		return errors.New("bad trusted proxies: " + err.Error())
+	}
+	if config.ProxyProtocol && len(config.TrustedProxies) == 0 {
+		return errors.New("proxy protocol requires trusted proxies")
+	}
+	if config.AdminListen != "" && config.AdminToken == "" && config.AdminClientCAFile == "" {
+		return errors.New("admin listener requires an admin token or client ca")
+	}
+	if (config.AdminTLSCertFile == "") != (config.AdminTLSKeyFile == "") {
+		return errors.New("admin tls requires both a certificate and a key")
+	}
+	if config.AdminClientCAFile != "" && config.AdminTLSCertFile == "" {
+		return errors.New("admin client ca requires admin tls")
+	}
+	kids := make(map[string]bool)
+	for _, key := range config.SigningKeys {
+		if key.ID == "" || key.Secret == "" {
+			return errors.New("signing keys require an id and a secret")
+		}
+		if kids[key.ID] {
+			return errors.New("duplicate signing key " + key.ID)
+		}
+		kids[key.ID] = true
+	}
+	if config.SigRequired && config.Secret == "" && len(config.SigningKeys) == 0 {
+		return errors.New("sig is required but no secret or signing keys provided")
+	}
+	return nil
+}
+
+func readConfigFile(configPath string, conf *Configuration) error {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewDecoder(file).Decode(conf)
+}
+
+// configName joins the words of a Configuration field name in lower case
+// with sep, e.g. S3AccessKey with "_" gives s3_access_key
+func configName(fieldName string, sep string) string {
+	var words []string
+	start := 0
+	for i := 1; i < len(fieldName); i++ {
+		prev, cur := fieldName[i-1], fieldName[i]
+		// an upper case letter followed by lower case ones starts a word after
+		// an acronym, unless it is the plural s of the acronym as in TTLs
+		startsWord := i+1 < len(fieldName) && unicode.IsLower(rune(fieldName[i+1])) &&
+			!(fieldName[i+1] == 's' && (i+2 == len(fieldName) || unicode.IsUpper(rune(fieldName[i+2]))))
+		if unicode.IsUpper(rune(cur)) && (!unicode.IsUpper(rune(prev)) || startsWord) {
+			words = append(words, fieldName[start:i])
+			start = i
+		}
+	}
+	words = append(words, fieldName[start:])
+	return strings.ToLower(strings.Join(words, sep))
+}
+
+// setConfigField parses value into field. Lists of strings are comma
+// separated, other lists and maps are JSON. Errors never include the value
+// as it may be a secret.
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		field.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return errors.New("not a positive integer")
+		}
+		field.SetUint(n)
+	default:
+		if field.Type() == reflect.TypeOf([]string{}) && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var list []string
+			for _, elem := range strings.Split(value, ",") {
+				if elem = strings.TrimSpace(elem); elem != "" {
+					list = append(list, elem)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+			return nil
+		}
+		if json.Unmarshal([]byte(value), field.Addr().Interface()) != nil {
+			return errors.New("not valid JSON")
+		}
+	}
+	return nil
+}
+
+// configFlag collects the command-line value of a Configuration field so that
+// it can be applied after the configuration file and environment variables
+type configFlag struct {
+	fieldName string
+	isBool    bool
+	overrides map[string]string
+}
+
+func (f configFlag) String() string {
+	return ""
+}
+
+func (f configFlag) Set(value string) error {
+	f.overrides[f.fieldName] = value
+	return nil
+}
+
+func (f configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// String prints the configuration as JSON with secrets, the fields tagged
+// secret, replaced
+func (conf Configuration) String() string {
+	redacted := make(map[string]interface{})
+	fields := reflect.ValueOf(conf)
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		value := fields.Field(i).Interface()
+		if field.Tag.Get("secret") == "true" && !fields.Field(i).IsZero() {
+			value = "REDACTED"
+		}
+		redacted[field.Name] = value
+	}
+	v, _ := json.Marshal(redacted)
+	return string(v)
+}
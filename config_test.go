@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import "testing"
+
+func TestConfigName(t *testing.T) {
+	tests := []struct {
+		fieldName string
+		want      string
+	}{
+		{"Listen", "listen"},
+		{"S3AccessKey", "s3_access_key"},
+		{"OriginURL", "origin_url"},
+		{"TLSCertFile", "tls_cert_file"},
+		{"AdminTLSCertFile", "admin_tls_cert_file"},
+		{"ACMEHosts", "acme_hosts"},
+		{"DefaultTTLs", "default_ttls"},
+		{"AllowSigV1", "allow_sig_v1"},
+		{"OriginHeaderTimeoutInSeconds", "origin_header_timeout_in_seconds"},
+	}
+	for _, test := range tests {
+		if got := configName(test.fieldName, "_"); got != test.want {
+			t.Errorf("configName(%q) = %q, want %q", test.fieldName, got, test.want)
+		}
+	}
+	if got := configName("ACMEHosts", "-"); got != "acme-hosts" {
+		t.Errorf(`configName("ACMEHosts", "-") = %q, want "acme-hosts"`, got)
+	}
+}
@@ -23,67 +23,467 @@
 package main
 
 import (
-	"github.com/syndtr/goleveldb/leveldb"
-	"sort"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
 	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The database holds a record per cached file under filePrefix+path and an
+// index ordered by eviction priority under evictionPrefix+priority+"/"+path so
+// that eviction can walk files from lowest to highest priority without loading
+// every record.
+const (
+	filePrefix        = "file/"
+	missingPrefix     = "missing/"
+	evictionPrefix    = "evict/"
+	versionKey        = "meta/version"
+	policyKey         = "meta/policy"
+	lastEvictedKey    = "meta/lastevicted"
+	databaseVersion   = "3"
+	legacyATimePrefix = "atime/"
 )
 
-func GetDatabase(path string) (db *leveldb.DB, err error) {
-	return leveldb.OpenFile(path, nil)
+// migrationBatchSize is how many updates migrations and index rebuilds write
+// at once, so that large databases needn't be held in memory
+const migrationBatchSize = 3000
+
+type Database struct {
+	*leveldb.DB
+	policy EvictionPolicy
+	// recordsMu serializes read-modify-write updates of records so that the
+	// eviction index never points to outdated records
+	recordsMu   sync.Mutex
+	lastEvicted uint64
+}
+
+// FileRecord is what the database knows about a cached file. Sliced files
+// have no file of their own in the cache, only their slices do.
+type FileRecord struct {
+	AccessedAt     time.Time
+	ValidatedAt    time.Time
+	ETag           string
+	LastModifiedAt time.Time
+	SizeInBytes    uint64
+	Sliced         bool
+	Hits           uint64
+	Priority       uint64
+	Header         http.Header
+	ExpiresAt      time.Time
+}
+
+// expired reports whether the cached copy went stale according to origin's
+// cache headers or a default TTL
+func (record FileRecord) expired(now time.Time) bool {
+	return !record.ExpiresAt.IsZero() && !now.Before(record.ExpiresAt)
 }
 
-func PutFile(db *leveldb.DB, path string) (err error) {
-	timeBinary, err := time.Now().MarshalBinary()
+// staleFor returns how long ago the cached copy expired, 0 if it hasn't
+func (record FileRecord) staleFor(now time.Time) time.Duration {
+	if !record.expired(now) {
+		return 0
+	}
+	return now.Sub(record.ExpiresAt)
+}
+
+func GetDatabase(path string, policy EvictionPolicy) (db *Database, err error) {
+	levelDB, err := leveldb.OpenFile(path, nil)
 	if err != nil {
 		return
 	}
-	err = db.Put([]byte(path), timeBinary, nil)
+	db = &Database{DB: levelDB, policy: policy}
+	err = migrateDatabase(db)
+	if err == nil {
+		err = loadEvictionPolicy(db)
+	}
+	if err != nil {
+		levelDB.Close()
+		db = nil
+	}
 	return
 }
 
-func HasFile(db *leveldb.DB, path string) (bool, error) {
-	return db.Has([]byte(path), nil)
+// migrateDatabase converts databases of older versions. Version 1 had a
+// single key per file holding its binary encoded access time, version 2 an
+// index by access time which is rebuilt as the eviction index.
+func migrateDatabase(db *Database) error {
+	version, err := db.Get([]byte(versionKey), nil)
+	if err == nil && string(version) == databaseVersion {
+		return nil
+	}
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	log.Println("migrating database")
+	if err == leveldb.ErrNotFound {
+		err = migrateDatabaseV1(db)
+		if err != nil {
+			return err
+		}
+	}
+	// forces loadEvictionPolicy to rebuild the index
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(policyKey))
+	batch.Put([]byte(versionKey), []byte(databaseVersion))
+	return db.Write(batch, nil)
+}
+
+func migrateDatabaseV1(db *Database) error {
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		path := string(iter.Key())
+		batch.Delete(iter.Key())
+		record, err := decodeFileRecord(iter.Value())
+		if err != nil {
+			log.Printf("dropping undecodable record of %s: %s", path, err)
+			continue
+		}
+		v, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		batch.Put(fileKey(path), v)
+		err = flushBatch(db, batch)
+		if err != nil {
+			return err
+		}
+	}
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+	return db.Write(batch, nil)
+}
+
+// flushBatch writes batch once it holds migrationBatchSize updates
+func flushBatch(db *Database, batch *leveldb.Batch) error {
+	if batch.Len() < migrationBatchSize {
+		return nil
+	}
+	err := db.Write(batch, nil)
+	batch.Reset()
+	return err
+}
+
+// loadEvictionPolicy rebuilds the eviction index when the policy changed
+// since the database was last opened. The policy is recorded last so that an
+// interrupted rebuild starts over on the next start.
+func loadEvictionPolicy(db *Database) error {
+	name, err := db.Get([]byte(policyKey), nil)
+	if err == nil && string(name) == db.policy.Name() {
+		lastEvicted, err := db.Get([]byte(lastEvictedKey), nil)
+		if err == nil && len(lastEvicted) == 8 {
+			db.lastEvicted = binary.BigEndian.Uint64(lastEvicted)
+		}
+		return nil
+	}
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	log.Printf("rebuilding eviction index for %s policy", db.policy.Name())
+	batch := new(leveldb.Batch)
+	for _, prefix := range []string{evictionPrefix, legacyATimePrefix} {
+		iter := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		for iter.Next() {
+			batch.Delete(iter.Key())
+			err = flushBatch(db, batch)
+			if err != nil {
+				iter.Release()
+				return err
+			}
+		}
+		iter.Release()
+		err = iter.Error()
+		if err != nil {
+			return err
+		}
+	}
+	iter := db.NewIterator(util.BytesPrefix([]byte(filePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		path := string(bytes.TrimPrefix(iter.Key(), []byte(filePrefix)))
+		record, err := decodeFileRecord(iter.Value())
+		if err != nil {
+			return err
+		}
+		record.Priority = db.policy.Priority(record, 0)
+		v, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		batch.Put(fileKey(path), v)
+		batch.Put(evictionKey(path, record.Priority), nil)
+		err = flushBatch(db, batch)
+		if err != nil {
+			return err
+		}
+	}
+	err = iter.Error()
+	if err != nil {
+		return err
+	}
+	batch.Delete([]byte(lastEvictedKey))
+	batch.Put([]byte(policyKey), []byte(db.policy.Name()))
+	return db.Write(batch, nil)
+}
+
+func fileKey(path string) []byte {
+	return []byte(filePrefix + path)
+}
+
+func evictionKey(path string, priority uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d/%s", evictionPrefix, priority, path))
 }
 
-func DeleteFile(db *leveldb.DB, path string) (err error) {
-	err = db.Delete([]byte(path), nil)
+func decodeFileRecord(v []byte) (record FileRecord, err error) {
+	if len(v) > 0 && v[0] == '{' {
+		err = json.Unmarshal(v, &record)
+		return
+	}
+	// version 1 only stored the access time
+	err = record.AccessedAt.UnmarshalBinary(v)
 	return
 }
 
-type PathModified struct {
-	path           string
-	lastModifiedAt time.Time
+func GetFile(db *Database, path string) (record FileRecord, found bool, err error) {
+	v, err := db.Get(fileKey(path), nil)
+	if err == leveldb.ErrNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	record, err = decodeFileRecord(v)
+	found = err == nil
+	return
 }
 
-type ByLastModifiedAt []PathModified
+// updateFile applies update to the record of path, creating it if needed,
+// and moves the file in the eviction index
+func updateFile(db *Database, path string, update func(record *FileRecord)) (record FileRecord, err error) {
+	db.recordsMu.Lock()
+	defer db.recordsMu.Unlock()
+	old, found, err := GetFile(db, path)
+	if err != nil {
+		return
+	}
+	record = old
+	update(&record)
+	record.Priority = db.policy.Priority(record, db.lastEvicted)
+	v, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	batch := new(leveldb.Batch)
+	if found && old.Priority != record.Priority {
+		batch.Delete(evictionKey(path, old.Priority))
+	}
+	batch.Put(evictionKey(path, record.Priority), nil)
+	batch.Put(fileKey(path), v)
+	err = db.Write(batch, nil)
+	return
+}
 
-func (a ByLastModifiedAt) Len() int      { return len(a) }
-func (a ByLastModifiedAt) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByLastModifiedAt) Less(i, j int) bool {
-	return a[i].lastModifiedAt.Before(a[j].lastModifiedAt)
+// PutFile records an access to path
+func PutFile(db *Database, path string) (err error) {
+	_, err = updateFile(db, path, func(record *FileRecord) {
+		record.AccessedAt = time.Now()
+		record.Hits++
+	})
+	return
 }
 
-func ListPathsByModificationTime(db *leveldb.DB) (paths []string, err error) {
-	var pathModified []PathModified
-	iter := db.NewIterator(nil, nil)
+// PutFileStat stores the origin's validators for path and marks it as just
+// validated. A 404 or 403 remembered for path is forgotten.
+func PutFileStat(db *Database, path string, stat Stat) (err error) {
+	_, err = updateFile(db, path, func(record *FileRecord) {
+		now := time.Now()
+		record.AccessedAt = now
+		record.ValidatedAt = now
+		record.ETag = stat.ETag
+		record.LastModifiedAt = stat.LastModifiedAt
+		record.SizeInBytes = stat.SizeInBytes
+		record.Header = stat.Header
+		record.ExpiresAt = stat.ExpiresAt
+		record.Sliced = false
+		if record.Hits == 0 {
+			record.Hits = 1
+		}
+	})
+	if err == nil {
+		_, err = DeleteMissingFile(db, path)
+	}
+	return
+}
+
+// PutSlicedFile is PutFileStat for files cached in slices
+func PutSlicedFile(db *Database, path string, stat Stat) (record FileRecord, err error) {
+	record, err = updateFile(db, path, func(record *FileRecord) {
+		now := time.Now()
+		record.AccessedAt = now
+		record.ValidatedAt = now
+		record.ETag = stat.ETag
+		record.LastModifiedAt = stat.LastModifiedAt
+		record.SizeInBytes = stat.SizeInBytes
+		record.Header = stat.Header
+		record.ExpiresAt = stat.ExpiresAt
+		record.Sliced = true
+		if record.Hits == 0 {
+			record.Hits = 1
+		}
+	})
+	if err == nil {
+		_, err = DeleteMissingFile(db, path)
+	}
+	return
+}
+
+func HasFile(db *Database, path string) (bool, error) {
+	return db.Has(fileKey(path), nil)
+}
+
+func DeleteFile(db *Database, path string) (err error) {
+	db.recordsMu.Lock()
+	defer db.recordsMu.Unlock()
+	record, found, err := GetFile(db, path)
+	if err != nil || !found {
+		return
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(evictionKey(path, record.Priority))
+	batch.Delete(fileKey(path))
+	err = db.Write(batch, nil)
+	return
+}
+
+// ListPathsWithPrefix returns every file whose path starts with prefix
+func ListPathsWithPrefix(db *Database, prefix string) (paths []string, err error) {
+	iter := db.NewIterator(util.BytesPrefix(fileKey(prefix)), nil)
 	defer iter.Release()
 	for iter.Next() {
-		k := iter.Key()
-		v := iter.Value()
-		path := string(k[:])
-		lastModifiedAt := time.Now()
-		err := lastModifiedAt.UnmarshalBinary(v)
-		if err != nil {
-			return nil, err
+		paths = append(paths, string(bytes.TrimPrefix(iter.Key(), []byte(filePrefix))))
+	}
+	err = iter.Error()
+	return
+}
+
+// MissingRecord remembers that origin answered a request for a file with
+// Status (404 or 403) until ExpiresAt
+type MissingRecord struct {
+	Status    int
+	CachedAt  time.Time
+	ExpiresAt time.Time
+}
+
+func missingKey(path string) []byte {
+	return []byte(missingPrefix + path)
+}
+
+func GetMissingFile(db *Database, path string) (record MissingRecord, found bool, err error) {
+	v, err := db.Get(missingKey(path), nil)
+	if err == leveldb.ErrNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(v, &record)
+	found = err == nil
+	return
+}
+
+func PutMissingFile(db *Database, path string, record MissingRecord) error {
+	v, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return db.Put(missingKey(path), v, nil)
+}
+
+func DeleteMissingFile(db *Database, path string) (found bool, err error) {
+	found, err = db.Has(missingKey(path), nil)
+	if err != nil || !found {
+		return
+	}
+	err = db.Delete(missingKey(path), nil)
+	return
+}
+
+// DeleteMissingFiles deletes the missing records of paths starting with
+// prefix for which shouldDelete returns true and returns how many it deleted
+func DeleteMissingFiles(db *Database, prefix string, shouldDelete func(record MissingRecord) bool) (deleted int, err error) {
+	iter := db.NewIterator(util.BytesPrefix(missingKey(prefix)), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		var record MissingRecord
+		if json.Unmarshal(iter.Value(), &record) != nil || shouldDelete(record) {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+			deleted++
 		}
-		pathModified = append(pathModified, PathModified{path, lastModifiedAt})
 	}
+	err = iter.Error()
 	if err != nil {
 		return
 	}
-	sort.Sort(ByLastModifiedAt(pathModified))
-	for _, aPathModified := range pathModified {
-		paths = append(paths, aPathModified.path)
+	err = db.Write(batch, nil)
+	return
+}
+
+// EvictFile is DeleteFile for files removed to free space, their priority is
+// taken into account by the eviction policy
+func EvictFile(db *Database, path string, record FileRecord) (err error) {
+	err = DeleteFile(db, path)
+	if err != nil {
+		return
 	}
+	db.recordsMu.Lock()
+	defer db.recordsMu.Unlock()
+	if record.Priority <= db.lastEvicted {
+		return
+	}
+	db.lastEvicted = record.Priority
+	lastEvicted := make([]byte, 8)
+	binary.BigEndian.PutUint64(lastEvicted, db.lastEvicted)
+	err = db.Put([]byte(lastEvictedKey), lastEvicted, nil)
 	return
 }
+
+// WalkPathsByEvictionOrder calls walkFn with every file from lowest to
+// highest eviction priority until walkFn returns false. Files may be deleted
+// while walking.
+func WalkPathsByEvictionOrder(db *Database, walkFn func(path string, record FileRecord) bool) error {
+	iter := db.NewIterator(util.BytesPrefix([]byte(evictionPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := bytes.TrimPrefix(iter.Key(), []byte(evictionPrefix))
+		i := bytes.IndexByte(key, '/')
+		if i < 0 {
+			continue
+		}
+		path := string(key[i+1:])
+		record, found, err := GetFile(db, path)
+		if err != nil {
+			return err
+		}
+		if !found || !bytes.Equal(evictionKey(path, record.Priority), iter.Key()) {
+			// file got deleted or accessed since the iterator was created
+			continue
+		}
+		if !walkFn(path, record) {
+			break
+		}
+	}
+	return iter.Error()
+}
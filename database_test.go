@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func countKeys(t *testing.T, db *leveldb.DB, prefix string) int {
+	iter := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// seedDatabase writes keys as they are to a new LevelDB in dir
+func seedDatabase(t *testing.T, dir string, keys map[string][]byte) {
+	levelDB, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := new(leveldb.Batch)
+	for key, value := range keys {
+		batch.Put([]byte(key), value)
+	}
+	err = levelDB.Write(batch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	levelDB.Close()
+}
+
+// checkMigrated checks that every path of accessedAt has a record with that
+// access time indexed for LRU eviction
+func checkMigrated(t *testing.T, db *Database, accessedAt map[string]time.Time) {
+	t.Helper()
+	version, err := db.Get([]byte(versionKey), nil)
+	if err != nil || string(version) != databaseVersion {
+		t.Errorf("got version %q (%v), want %s", version, err, databaseVersion)
+	}
+	policy, err := db.Get([]byte(policyKey), nil)
+	if err != nil || string(policy) != EvictionPolicyLRU {
+		t.Errorf("got policy %q (%v), want %s", policy, err, EvictionPolicyLRU)
+	}
+	for path, want := range accessedAt {
+		record, found, err := GetFile(db, path)
+		if err != nil || !found {
+			t.Fatalf("%s: no record (%v)", path, err)
+		}
+		if !record.AccessedAt.Equal(want) {
+			t.Errorf("%s: got access time %s, want %s", path, record.AccessedAt, want)
+		}
+		has, err := db.Has(evictionKey(path, uint64(want.UnixNano())), nil)
+		if err != nil || !has {
+			t.Errorf("%s: not in the eviction index (%v)", path, err)
+		}
+	}
+	if n := countKeys(t, db.DB, filePrefix); n != len(accessedAt) {
+		t.Errorf("got %d records, want %d", n, len(accessedAt))
+	}
+	if n := countKeys(t, db.DB, evictionPrefix); n != len(accessedAt) {
+		t.Errorf("got %d eviction keys, want %d", n, len(accessedAt))
+	}
+	if n := countKeys(t, db.DB, legacyATimePrefix); n != 0 {
+		t.Errorf("%d legacy index keys left", n)
+	}
+}
+
+func TestMigrateDatabaseV1(t *testing.T) {
+	dir := t.TempDir()
+	// more than a batch, so that the migration and the rebuild flush
+	keys := make(map[string][]byte)
+	accessedAt := make(map[string]time.Time)
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < migrationBatchSize+500; i++ {
+		path := fmt.Sprintf("dir%d/file%d.ext", i%7, i)
+		accessedAt[path] = start.Add(time.Duration(i) * time.Second)
+		v, err := accessedAt[path].MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[path] = v
+	}
+	seedDatabase(t, dir, keys)
+
+	db, err := GetDatabase(dir, LRUPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkMigrated(t, db, accessedAt)
+	for path := range keys {
+		if has, _ := db.Has([]byte(path), nil); has {
+			t.Fatalf("v1 key of %s left", path)
+		}
+	}
+	// oldest first
+	previous := time.Time{}
+	walked := 0
+	err = WalkPathsByEvictionOrder(db, func(path string, record FileRecord) bool {
+		if record.AccessedAt.Before(previous) {
+			t.Fatalf("%s walked after a file accessed later", path)
+		}
+		previous = record.AccessedAt
+		walked++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walked != len(keys) {
+		t.Errorf("walked %d files, want %d", walked, len(keys))
+	}
+}
+
+func TestMigrateDatabaseV2(t *testing.T) {
+	dir := t.TempDir()
+	accessedAt := map[string]time.Time{
+		"a": time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+		"b": time.Date(2017, 6, 2, 12, 0, 0, 0, time.UTC),
+	}
+	keys := map[string][]byte{versionKey: []byte("2")}
+	for path, at := range accessedAt {
+		v, err := json.Marshal(FileRecord{AccessedAt: at, ETag: `"v1"`})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[filePrefix+path] = v
+		keys[fmt.Sprintf("%s%020d/%s", legacyATimePrefix, at.UnixNano(), path)] = nil
+	}
+	seedDatabase(t, dir, keys)
+
+	db, err := GetDatabase(dir, LRUPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkMigrated(t, db, accessedAt)
+	record, _, err := GetFile(db, "a")
+	if err != nil || record.ETag != `"v1"` {
+		t.Errorf("got ETag %s (%v), want \"v1\"", record.ETag, err)
+	}
+}
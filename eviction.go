@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+)
+
+const (
+	EvictionPolicyLRU = "lru"
+	EvictionPolicyLFU = "lfu"
+)
+
+// EvictionPolicy orders cached files for eviction. The database indexes files
+// by their priority, files with the lowest priority are evicted first.
+type EvictionPolicy interface {
+	Name() string
+	// Priority returns the priority of a file that was just accessed, given
+	// the priority of the last evicted file
+	Priority(record FileRecord, lastEvicted uint64) uint64
+}
+
+// LRUPolicy evicts least recently used files first
+type LRUPolicy struct{}
+
+func (p LRUPolicy) Name() string {
+	return EvictionPolicyLRU
+}
+
+func (p LRUPolicy) Priority(record FileRecord, lastEvicted uint64) uint64 {
+	if record.AccessedAt.IsZero() {
+		return 0
+	}
+	return uint64(record.AccessedAt.UnixNano())
+}
+
+// LFUPolicy evicts least frequently used files first, with dynamic aging
+// (LFU-DA): a file's priority is its hit count plus the priority of the last
+// evicted file when it was accessed. Files that were popular a long time ago
+// end up below files accessed recently instead of staying in the cache
+// forever, while one-off downloads can't flush files that are hit often.
+type LFUPolicy struct{}
+
+func (p LFUPolicy) Name() string {
+	return EvictionPolicyLFU
+}
+
+func (p LFUPolicy) Priority(record FileRecord, lastEvicted uint64) uint64 {
+	return lastEvicted + record.Hits
+}
+
+func GetEvictionPolicy(config Configuration) (EvictionPolicy, error) {
+	switch config.EvictionPolicy {
+	case "", EvictionPolicyLRU:
+		return LRUPolicy{}, nil
+	case EvictionPolicyLFU:
+		return LFUPolicy{}, nil
+	default:
+		return nil, errors.New("unknown eviction policy " + config.EvictionPolicy)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func evictionOrder(t *testing.T, db *Database) []string {
+	t.Helper()
+	var paths []string
+	err := WalkPathsByEvictionOrder(db, func(path string, record FileRecord) bool {
+		paths = append(paths, path)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func access(t *testing.T, db *Database, path string, times int) {
+	t.Helper()
+	for i := 0; i < times; i++ {
+		if err := PutFile(db, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkEvictionOrder(t *testing.T, db *Database, want ...string) {
+	t.Helper()
+	if got := evictionOrder(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("got eviction order %v, want %v", got, want)
+	}
+}
+
+func TestLFUPolicyAging(t *testing.T) {
+	dir := t.TempDir()
+	db, err := GetDatabase(dir, LFUPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access(t, db, "a", 3)
+	access(t, db, "b", 1)
+	access(t, db, "c", 2)
+	checkEvictionOrder(t, db, "b", "c", "a")
+
+	for _, path := range []string{"b", "c"} {
+		record, _, err := GetFile(db, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = EvictFile(db, path, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// d starts from the priority of c, the last evicted file, so that two
+	// recent hits outweigh the three hits a got long ago
+	access(t, db, "d", 2)
+	checkEvictionOrder(t, db, "a", "d")
+	if record, _, _ := GetFile(db, "d"); record.Priority != 2+2 {
+		t.Errorf("got priority %d for d, want 4", record.Priority)
+	}
+
+	// the age survives restarts
+	db.Close()
+	db, err = GetDatabase(dir, LFUPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	access(t, db, "e", 1)
+	if record, _, _ := GetFile(db, "e"); record.Priority != 2+1 {
+		t.Errorf("got priority %d for e, want 3", record.Priority)
+	}
+	checkEvictionOrder(t, db, "a", "e", "d")
+}
+
+func TestSwitchEvictionPolicy(t *testing.T) {
+	dir := t.TempDir()
+	db, err := GetDatabase(dir, LRUPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access(t, db, "popular", 3)
+	access(t, db, "recent", 1)
+	checkEvictionOrder(t, db, "popular", "recent")
+	db.Close()
+
+	for _, policy := range []EvictionPolicy{LFUPolicy{}, LRUPolicy{}} {
+		db, err = GetDatabase(dir, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, err := db.Get([]byte(policyKey), nil); err != nil || string(name) != policy.Name() {
+			t.Errorf("got policy %q (%v), want %s", name, err, policy.Name())
+		}
+		if n := countKeys(t, db.DB, evictionPrefix); n != 2 {
+			t.Errorf("%s: got %d eviction keys, want 2", policy.Name(), n)
+		}
+		if policy.Name() == EvictionPolicyLFU {
+			checkEvictionOrder(t, db, "recent", "popular")
+		} else {
+			checkEvictionOrder(t, db, "popular", "recent")
+		}
+		db.Close()
+	}
+}
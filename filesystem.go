@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type FilesystemClient struct {
+	root string
+}
+
+// buildFilesystemPath returns where path is under the root, refusing paths
+// that leave it, including through symlinks
+func (c FilesystemClient) buildFilesystemPath(path string) (string, error) {
+	fullPath := filepath.Join(c.root, filepath.FromSlash(path))
+	if !c.underRoot(fullPath) {
+		return "", errors.New("path outside of filesystem root")
+	}
+	resolvedPath, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		// missing files are reported when they are opened
+		return fullPath, nil
+	}
+	if !c.underRoot(resolvedPath) {
+		return "", errors.New("path outside of filesystem root")
+	}
+	return resolvedPath, nil
+}
+
+func (c FilesystemClient) underRoot(fullPath string) bool {
+	return fullPath == c.root || strings.HasPrefix(fullPath, c.root+string(filepath.Separator))
+}
+
+func (c FilesystemClient) Stat(path string) (Stat, *StorageProviderError) {
+	fullPath, err := c.buildFilesystemPath(path)
+	if err != nil {
+		return Stat{}, &StorageProviderError{http.StatusBadRequest, err}
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return Stat{}, filesystemError(err)
+	}
+	if stat.IsDir() {
+		return Stat{}, &StorageProviderError{http.StatusNotFound, errors.New("is a directory")}
+	}
+	return filesystemStat(path, stat), nil
+}
+
+func filesystemStat(path string, stat os.FileInfo) Stat {
+	return Stat{
+		Path:           path,
+		SizeInBytes:    uint64(stat.Size()),
+		LastModifiedAt: stat.ModTime(),
+		ETag:           fmt.Sprintf("\"%x-%x\"", stat.ModTime().UnixNano(), stat.Size()),
+	}
+}
+
+func (c FilesystemClient) Read(path string, w *CacheWriter) *StorageProviderError {
+	fullPath, err := c.buildFilesystemPath(path)
+	if err != nil {
+		return &StorageProviderError{http.StatusBadRequest, err}
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return filesystemError(err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return filesystemError(err)
+	}
+	if stat.IsDir() {
+		return &StorageProviderError{http.StatusNotFound, errors.New("is a directory")}
+	}
+	w.WriteStat(filesystemStat(path, stat))
+	w.WriteSize(stat.Size())
+	_, err = io.Copy(w, file)
+	if err != nil {
+		return &StorageProviderError{http.StatusRequestTimeout, err}
+	}
+	return nil
+}
+
+func (c FilesystemClient) ReadRange(path string, offset int64, length int64, version Stat, w *CacheWriter) *StorageProviderError {
+	fullPath, err := c.buildFilesystemPath(path)
+	if err != nil {
+		return &StorageProviderError{http.StatusBadRequest, err}
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return filesystemError(err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return filesystemError(err)
+	}
+	if version.ETag != "" && filesystemStat(path, stat).ETag != version.ETag {
+		return &StorageProviderError{http.StatusPreconditionFailed, errors.New("file changed")}
+	}
+	if offset+length > stat.Size() {
+		return &StorageProviderError{http.StatusRequestedRangeNotSatisfiable, errors.New("range past end of file")}
+	}
+	w.WriteStat(filesystemStat(path, stat))
+	w.WriteSize(length)
+	_, err = io.Copy(w, io.NewSectionReader(file, offset, length))
+	if err != nil {
+		return &StorageProviderError{http.StatusRequestTimeout, err}
+	}
+	return nil
+}
+
+// List returns the files under prefix, skipping directories it can't read
+func (c FilesystemClient) List(prefix string) (paths []string, storageProviderError *StorageProviderError) {
+	// only walk the deepest directory containing every match
+	dir := c.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		dir, err = c.buildFilesystemPath(prefix[:i])
+		if err != nil {
+			return nil, &StorageProviderError{http.StatusBadRequest, err}
+		}
+	}
+	err := filepath.Walk(dir, func(fullPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			if fullPath == dir {
+				return err
+			}
+			return nil
+		}
+		if f.IsDir() {
+			return nil
+		}
+		path := filepath.ToSlash(strings.TrimPrefix(fullPath, c.root+string(filepath.Separator)))
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, filesystemError(err)
+	}
+	return paths, nil
+}
+
+func filesystemError(err error) *StorageProviderError {
+	// ENOTDIR is a path through a file, e.g. file.txt/anything
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return &StorageProviderError{http.StatusNotFound, err}
+	}
+	if os.IsPermission(err) {
+		return &StorageProviderError{http.StatusForbidden, err}
+	}
+	return &StorageProviderError{http.StatusInternalServerError, err}
+}
+
+func GetFilesystemClient(config Configuration) (client FilesystemClient, err error) {
+	root, err := filepath.Abs(config.FilesystemRoot)
+	if err != nil {
+		return
+	}
+	// resolved so that symlinks under it can be checked against it
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		return
+	}
+	if !stat.IsDir() {
+		err = errors.New("invalid filesystem root")
+		return
+	}
+	client = FilesystemClient{root: root}
+	return
+}
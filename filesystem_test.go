@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesystemStat(t *testing.T) {
+	root, err := ioutil.TempDir("", "filesystem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	for _, dir := range []string{root, outside} {
+		err = ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Mkdir(filepath.Join(root, "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(root, "file.txt"), filepath.Join(root, "dir", "inside"))
+	if err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	err = os.Symlink(outside, filepath.Join(root, "outside"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := GetFilesystemClient(Configuration{FilesystemRoot: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"file.txt", 0},
+		{"dir/inside", 0},
+		{"missing.txt", http.StatusNotFound},
+		{"dir", http.StatusNotFound},
+		{"file.txt/anything", http.StatusNotFound},
+		{"outside/file.txt", http.StatusBadRequest},
+		{"../file.txt", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		stat, storageProviderError := client.Stat(test.path)
+		status := 0
+		if storageProviderError != nil {
+			status = storageProviderError.status
+		}
+		if status != test.status {
+			t.Errorf("Stat(%q) = %d, want %d (%v)", test.path, status, test.status, storageProviderError)
+			continue
+		}
+		if status == 0 && stat.SizeInBytes != 5 {
+			t.Errorf("Stat(%q) size = %d, want 5", test.path, stat.SizeInBytes)
+		}
+	}
+}
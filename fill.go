@@ -0,0 +1,397 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	pathLib "path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// errFillPurged is returned when committing a fill whose path was purged
+// while it was running
+var errFillPurged = errors.New("purged while filling")
+
+// errFillNoStore is returned when committing a fill origin forbade caching
+var errFillNoStore = errors.New("origin forbids storing")
+
+// cacheFill is a fetch of a file from the storage provider into a temporary
+// file. Only one fill runs per path, every client asking for the path while it
+// runs streams from the temporary file as it grows.
+type cacheFill struct {
+	path    string
+	read    func(w *CacheWriter) *StorageProviderError
+	tmpName string
+	mu      sync.Mutex
+	cond    *sync.Cond
+	size    int64 // -1 until announced by the storage provider
+	written int64
+	stat    Stat
+	started bool
+	done    bool
+	err     *StorageProviderError
+}
+
+func newCacheFill(path string, read func(w *CacheWriter) *StorageProviderError, tmpName string) *cacheFill {
+	f := &cacheFill{path: path, read: read, tmpName: tmpName, size: -1}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// waitStarted blocks until the storage provider started writing the fill or
+// failed, returning the error of a fill that failed, even part-way through
+func (f *cacheFill) waitStarted() *StorageProviderError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.started && !f.done {
+		f.cond.Wait()
+	}
+	if f.done {
+		return f.err
+	}
+	return nil
+}
+
+type CacheWriter struct {
+	fill *cacheFill
+	io.Writer
+	bytesWritten int64
+}
+
+func (c *CacheWriter) Write(p []byte) (n int, err error) {
+	n, err = c.Writer.Write(p)
+	c.bytesWritten += int64(n)
+	c.fill.mu.Lock()
+	c.fill.written += int64(n)
+	c.fill.started = true
+	c.fill.mu.Unlock()
+	c.fill.cond.Broadcast()
+	return
+}
+
+// WriteSize announces the size of the file being read, sizeInBytes is -1
+// when the storage provider doesn't know it upfront (e.g. chunked responses)
+func (c *CacheWriter) WriteSize(sizeInBytes int64) {
+	c.fill.mu.Lock()
+	c.fill.size = sizeInBytes
+	c.fill.started = true
+	c.fill.mu.Unlock()
+	c.fill.cond.Broadcast()
+}
+
+// WriteStat records the origin's validators and headers for the file being
+// read so that the cached copy can later be revalidated against them and
+// served with the same headers. It must be called before WriteSize.
+func (c *CacheWriter) WriteStat(stat Stat) {
+	c.fill.mu.Lock()
+	c.fill.stat = stat
+	c.fill.mu.Unlock()
+}
+
+// waitDone blocks until the fill is done
+func (f *cacheFill) waitDone() *StorageProviderError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.done {
+		f.cond.Wait()
+	}
+	return f.err
+}
+
+// joinFill returns the running fill for path, starting one that gets its
+// contents from read if there is none, along with the fill's temporary file
+// opened for reading
+func (c *Cache) joinFill(path string, read func(w *CacheWriter) *StorageProviderError) (*cacheFill, *os.File, error) {
+	c.fillsMu.Lock()
+	defer c.fillsMu.Unlock()
+	f, ok := c.fills[path]
+	if !ok {
+		tmp, err := c.getTmpFile()
+		if err != nil {
+			return nil, nil, err
+		}
+		f = newCacheFill(path, read, tmp.Name())
+		c.fills[path] = f
+		go c.runFill(f, tmp)
+	}
+	// the fill is only removed from c.fills once its temporary file has been
+	// renamed, so opening it by name while holding c.fillsMu is safe
+	file, err := os.Open(f.tmpName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, file, nil
+}
+
+func (c *Cache) runFill(f *cacheFill, tmp *os.File) {
+	cacheWriter := CacheWriter{fill: f, Writer: tmp}
+	storageProviderError := f.read(&cacheWriter)
+	tmpErr := tmp.Close()
+	if storageProviderError == nil && tmpErr != nil {
+		storageProviderError = &StorageProviderError{http.StatusInternalServerError, tmpErr}
+	}
+	committed := false
+	if storageProviderError == nil {
+		err := c.commitFill(f, cacheWriter.bytesWritten)
+		if err == nil {
+			committed = true
+		} else if err != errFillPurged && err != errFillNoStore {
+			log.Printf("failed to cache %s: %s", f.path, err)
+		}
+	}
+	if !committed {
+		c.fillsMu.Lock()
+		c.forgetFill(f)
+		c.fillsMu.Unlock()
+		os.Remove(f.tmpName)
+	}
+
+	f.mu.Lock()
+	f.done = true
+	f.err = storageProviderError
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// forgetFill removes f from the running fills unless it was replaced by a
+// newer fill of the same path. c.fillsMu must be held.
+func (c *Cache) forgetFill(f *cacheFill) {
+	if c.fills[f.path] == f {
+		delete(c.fills, f.path)
+	}
+}
+
+// commitFill moves a completed fill into the cache directory
+func (c *Cache) commitFill(f *cacheFill, sizeInBytes int64) error {
+	f.mu.Lock()
+	stat := f.stat
+	f.mu.Unlock()
+	if stat.NoStore {
+		return errFillNoStore
+	}
+	fullPath := c.buildCachePath(f.path)
+	err := os.MkdirAll(pathLib.Dir(fullPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(f.tmpName, 0644)
+	if err != nil {
+		return err
+	}
+
+	c.fillsMu.Lock()
+	if c.fills[f.path] != f {
+		c.fillsMu.Unlock()
+		return errFillPurged
+	}
+	replacedSizeInBytes := int64(0)
+	replacedStat, err := os.Stat(fullPath)
+	if err == nil {
+		replacedSizeInBytes = replacedStat.Size()
+	}
+	err = os.Rename(f.tmpName, fullPath)
+	if err == nil {
+		c.forgetFill(f)
+	}
+	c.fillsMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.applyDefaultTTL(&stat)
+	err = PutFileStat(c.db, f.path, stat)
+	atomic.AddUint64(&c.bytesIn, uint64(sizeInBytes))
+	c.bytesUsedChan <- sizeInBytes - replacedSizeInBytes
+	return err
+}
+
+// serveFill streams a fill to a client as the storage provider writes it
+func (c *Cache) serveFill(f *cacheFill, file *os.File, cacheClient CacheClient) *CacheError {
+	storageProviderError := f.waitStarted()
+	if storageProviderError != nil {
+		return &CacheError{storageProviderError.status, storageProviderError}
+	}
+	f.mu.Lock()
+	if f.done && f.err != nil {
+		storageProviderError = f.err
+		f.mu.Unlock()
+		return &CacheError{storageProviderError.status, storageProviderError}
+	}
+	size := f.size
+	if size < 0 && f.done {
+		// the fill succeeded, so everything origin sent was written
+		size = f.written
+	}
+	etag := f.stat.ETag
+	storedHeader := f.stat.Header
+	f.mu.Unlock()
+
+	header := cacheClient.Header()
+	if size < 0 {
+		// without a size ranges can't be resolved until the fill is done
+		writeStoredHeader(header, f.path, storedHeader)
+		header.Set("Accept-Ranges", "none")
+		return c.copyFill(f, file, cacheClient, 0, -1)
+	}
+
+	start, end, partial, cacheError := resolveRange(cacheClient, size, etag)
+	if cacheError != nil {
+		return cacheError
+	}
+	// origin headers only go on a response that serves its content
+	writeStoredHeader(header, f.path, storedHeader)
+	header.Set("Accept-Ranges", "bytes")
+	writeRangeHeader(header, start, end, size, partial)
+	if partial {
+		cacheClient.WriteHeader(http.StatusPartialContent)
+	}
+	return c.copyFill(f, file, cacheClient, start, end)
+}
+
+// resolveRange works out which bytes [start, end) of a file of size bytes the
+// client asked for. Ranges are ignored if If-Range doesn't match etag.
+func resolveRange(cacheClient CacheClient, size int64, etag string) (start int64, end int64, partial bool, cacheError *CacheError) {
+	rangeHeader := cacheClient.req.Header.Get("Range")
+	ifRange := cacheClient.req.Header.Get("If-Range")
+	if rangeHeader == "" || (ifRange != "" && ifRange != etag) {
+		return 0, size, false, nil
+	}
+	start, end, err := parseByteRange(rangeHeader, size)
+	if err != nil {
+		cacheClient.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return 0, 0, false, &CacheError{http.StatusRequestedRangeNotSatisfiable, err}
+	}
+	return start, end, start != 0 || end != size, nil
+}
+
+// writeRangeHeader sets Content-Length, and Content-Range if partial, for
+// bytes [start, end) of a file of size bytes
+func writeRangeHeader(header http.Header, start int64, end int64, size int64, partial bool) {
+	header.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	if partial {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+}
+
+// copyFill copies bytes [start, end) of a fill to a client, waiting for the
+// storage provider to write them if needed. An end of -1 copies until the fill
+// is done.
+func (c *Cache) copyFill(f *cacheFill, file *os.File, cacheClient CacheClient, start int64, end int64) *CacheError {
+	buf := make([]byte, 32*1024)
+	offset := start
+	for end < 0 || offset < end {
+		f.mu.Lock()
+		for f.written <= offset && !f.done {
+			f.cond.Wait()
+		}
+		written := f.written
+		fillErr := f.err
+		f.mu.Unlock()
+		if offset >= written {
+			if fillErr != nil {
+				return &CacheError{fillErr.status, fillErr}
+			}
+			if end >= 0 {
+				return &CacheError{http.StatusBadGateway, errors.New("origin sent less than announced")}
+			}
+			return nil
+		}
+		n := written - offset
+		if end >= 0 && n > end-offset {
+			n = end - offset
+		}
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		_, err := file.ReadAt(buf[:n], offset)
+		if err != nil {
+			return &CacheError{http.StatusInternalServerError, err}
+		}
+		_, err = cacheClient.Write(buf[:n])
+		if err != nil {
+			return &CacheError{http.StatusRequestTimeout, errors.New("client went away")}
+		}
+		offset += n
+		atomic.AddUint64(&c.bytesOut, uint64(n))
+	}
+	return nil
+}
+
+// parseByteRange resolves a single range Range header against a file of size
+// bytes, returning the range as [start, end). Multiple ranges are served as the
+// whole file.
+func parseByteRange(rangeHeader string, size int64) (start int64, end int64, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		err = errors.New("invalid range")
+		return
+	}
+	spec := strings.TrimSpace(rangeHeader[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return 0, size, nil
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		err = errors.New("invalid range")
+		return
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" {
+		// suffix range, the last n bytes
+		n, parseErr := strconv.ParseInt(last, 10, 64)
+		if parseErr != nil || n <= 0 {
+			err = errors.New("invalid range")
+			return
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		err = errors.New("invalid range")
+		return
+	}
+	end = size
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			err = errors.New("invalid range")
+			return
+		}
+		end++
+		if end > size {
+			end = size
+		}
+	}
+	return start, end, nil
+}
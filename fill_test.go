@@ -0,0 +1,354 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		rangeHeader string
+		start       int64
+		end         int64
+		err         bool
+	}{
+		{"bytes=0-4", 0, 5, false},
+		{"bytes=0-0", 0, 1, false},
+		{"bytes=5-", 5, 10, false},
+		{"bytes=2-100", 2, 10, false},
+		{"bytes= 1 - 2", 1, 3, false},
+		{"bytes=-3", 7, 10, false},
+		{"bytes=-20", 0, 10, false},
+		{"bytes=0-1,4-5", 0, 10, false},
+		{"bytes=10-", 0, 0, true},
+		{"bytes=5-4", 0, 0, true},
+		{"bytes=-0", 0, 0, true},
+		{"bytes=-", 0, 0, true},
+		{"bytes=abc", 0, 0, true},
+		{"bytes=a-b", 0, 0, true},
+		{"items=0-4", 0, 0, true},
+	}
+	for _, test := range tests {
+		start, end, err := parseByteRange(test.rangeHeader, 10)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got [%d, %d), want an error", test.rangeHeader, start, end)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.rangeHeader, err)
+			continue
+		}
+		if start != test.start || end != test.end {
+			t.Errorf("%q: got [%d, %d), want [%d, %d)", test.rangeHeader, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestResolveRange(t *testing.T) {
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		ifRange      string
+		start        int64
+		end          int64
+		partial      bool
+		status       int // 0 if the range resolves
+		contentRange string
+	}{
+		{"no range", "", "", 0, 10, false, 0, ""},
+		{"range", "bytes=2-4", "", 2, 5, true, 0, ""},
+		{"whole file", "bytes=0-", "", 0, 10, false, 0, ""},
+		{"multiple ranges", "bytes=0-1,4-5", "", 0, 10, false, 0, ""},
+		{"matching If-Range", "bytes=2-4", `"v1"`, 2, 5, true, 0, ""},
+		{"stale If-Range", "bytes=2-4", `"v0"`, 0, 10, false, 0, ""},
+		{"unsatisfiable", "bytes=20-", "", 0, 0, false, http.StatusRequestedRangeNotSatisfiable, "bytes */10"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/file", nil)
+		if test.rangeHeader != "" {
+			r.Header.Set("Range", test.rangeHeader)
+		}
+		if test.ifRange != "" {
+			r.Header.Set("If-Range", test.ifRange)
+		}
+		w := httptest.NewRecorder()
+		start, end, partial, cacheError := resolveRange(CacheClient{w, r}, 10, `"v1"`)
+		status := 0
+		if cacheError != nil {
+			status = cacheError.status
+		}
+		if status != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, status, test.status)
+			continue
+		}
+		if start != test.start || end != test.end || partial != test.partial {
+			t.Errorf("%s: got [%d, %d) partial %v, want [%d, %d) partial %v",
+				test.name, start, end, partial, test.start, test.end, test.partial)
+		}
+		if got := w.Header().Get("Content-Range"); got != test.contentRange {
+			t.Errorf("%s: got Content-Range %q, want %q", test.name, got, test.contentRange)
+		}
+	}
+}
+
+// signalingWriter closes wrote once something was written to it, or fails
+// every write if fail is set, like a client that went away
+type signalingWriter struct {
+	*httptest.ResponseRecorder
+	wrote chan struct{}
+	once  sync.Once
+	fail  bool
+}
+
+func newSignalingWriter(fail bool) *signalingWriter {
+	return &signalingWriter{ResponseRecorder: httptest.NewRecorder(), wrote: make(chan struct{}), fail: fail}
+}
+
+func (w *signalingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.wrote) })
+	if w.fail {
+		return 0, errors.New("client went away")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func readWith(c *Cache, path string, w http.ResponseWriter) *CacheError {
+	return c.Read(path, time.Unix(0, 0), CacheClient{w, httptest.NewRequest("GET", "/"+path, nil)})
+}
+
+// checkNoTmpFiles fails if fills left temporary files behind
+func checkNoTmpFiles(t *testing.T, c *Cache) {
+	t.Helper()
+	entries, err := os.ReadDir(c.tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d temporary files left", len(entries))
+	}
+}
+
+func TestFillCollapsesConcurrentMisses(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	provider := newStubProvider(map[string]stubFile{"a/file": {body: body, etag: `"v1"`}})
+	c := newTestCache(t, Configuration{}, provider)
+	halfway, resume := provider.gate()
+
+	const readers = 10
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, readers)
+	cacheErrors := make([]*CacheError, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i], cacheErrors[i] = get(c, "a/file", nil)
+		}(i)
+	}
+	<-halfway
+	resume()
+	wg.Wait()
+	for i := 0; i < readers; i++ {
+		if cacheErrors[i] != nil {
+			t.Fatalf("reader %d: %s", i, cacheErrors[i])
+		}
+		if responses[i].Body.String() != body {
+			t.Errorf("reader %d got %d bytes, want %d", i, responses[i].Body.Len(), len(body))
+		}
+	}
+	if n := provider.count("Read a/file"); n != 1 {
+		t.Errorf("origin got %d reads, want 1", n)
+	}
+	checkCached(t, c, "a/file", body)
+}
+
+func TestFillJoinedHalfway(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	provider := newStubProvider(map[string]stubFile{"a/file": {body: body, etag: `"v1"`}})
+	c := newTestCache(t, Configuration{}, provider)
+	halfway, resume := provider.gate()
+
+	first := newSignalingWriter(false)
+	firstDone := make(chan *CacheError)
+	go func() { firstDone <- readWith(c, "a/file", first) }()
+	<-halfway
+	f := runningFill(t, c, "a/file")
+	second := newSignalingWriter(false)
+	secondDone := make(chan *CacheError)
+	go func() { secondDone <- readWith(c, "a/file", second) }()
+	// the second reader streams the first half before origin sends the rest
+	<-second.wrote
+	resume()
+	for _, done := range []chan *CacheError{firstDone, secondDone} {
+		if cacheError := <-done; cacheError != nil {
+			t.Fatal(cacheError)
+		}
+	}
+	if f.waitDone() != nil {
+		t.Fatal("fill failed")
+	}
+	for _, w := range []*signalingWriter{first, second} {
+		if w.Body.String() != body {
+			t.Errorf("got %d bytes, want %d", w.Body.Len(), len(body))
+		}
+		if got := w.Header().Get("Content-Length"); got != "10000" {
+			t.Errorf("got Content-Length %s, want 10000", got)
+		}
+	}
+	if n := provider.count("Read a/file"); n != 1 {
+		t.Errorf("origin got %d reads, want 1", n)
+	}
+	checkCached(t, c, "a/file", body)
+	checkNoTmpFiles(t, c)
+}
+
+func TestFillFailingHalfway(t *testing.T) {
+	for _, status := range []int{http.StatusBadGateway, http.StatusRequestTimeout} {
+		body := strings.Repeat("0123456789", 1000)
+		provider := newStubProvider(map[string]stubFile{"a/file": {body: body, failStatus: status}})
+		c := newTestCache(t, Configuration{}, provider)
+		halfway, resume := provider.gate()
+
+		w := newSignalingWriter(false)
+		done := make(chan *CacheError)
+		go func() { done <- readWith(c, "a/file", w) }()
+		<-halfway
+		f := runningFill(t, c, "a/file")
+		resume()
+		cacheError := <-done
+		if cacheError == nil || cacheError.status != status {
+			t.Errorf("%d: got %v, want a %d error", status, cacheError, status)
+		}
+		if f.waitDone() == nil {
+			t.Errorf("%d: fill succeeded", status)
+		}
+		if w.Body.Len() >= len(body) {
+			t.Errorf("%d: got the whole body", status)
+		}
+		checkCached(t, c, "a/file", "")
+		checkNoTmpFiles(t, c)
+	}
+}
+
+func TestFillOutlivesClient(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	provider := newStubProvider(map[string]stubFile{"a/file": {body: body, etag: `"v1"`}})
+	c := newTestCache(t, Configuration{}, provider)
+	halfway, resume := provider.gate()
+
+	w := newSignalingWriter(true)
+	done := make(chan *CacheError)
+	go func() { done <- readWith(c, "a/file", w) }()
+	<-halfway
+	f := runningFill(t, c, "a/file")
+	cacheError := <-done
+	if cacheError == nil || cacheError.status != http.StatusRequestTimeout {
+		t.Errorf("got %v, want a 408 error", cacheError)
+	}
+	// the fill isn't the client's, it completes and is cached whole
+	resume()
+	if f.waitDone() != nil {
+		t.Fatal("fill failed")
+	}
+	checkCached(t, c, "a/file", body)
+	checkNoTmpFiles(t, c)
+}
+
+func TestFillPurgedWhileRunning(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	provider := newStubProvider(map[string]stubFile{"a/file": {body: body, etag: `"v1"`}})
+	c := newTestCache(t, Configuration{}, provider)
+	halfway, resume := provider.gate()
+
+	w := newSignalingWriter(false)
+	done := make(chan *CacheError)
+	go func() { done <- readWith(c, "a/file", w) }()
+	<-halfway
+	f := runningFill(t, c, "a/file")
+	stats, cacheError := c.Purge("a/file", false)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if stats.Purged != 0 {
+		t.Errorf("purged %d files, want 0", stats.Purged)
+	}
+	resume()
+	// the client still gets the file, it just isn't cached
+	if cacheError := <-done; cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != body {
+		t.Errorf("got %d bytes, want %d", w.Body.Len(), len(body))
+	}
+	if f.waitDone() != nil {
+		t.Fatal("fill failed")
+	}
+	checkCached(t, c, "a/file", "")
+	checkNoTmpFiles(t, c)
+
+	_, cacheError = get(c, "a/file", nil)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if n := provider.count("Read a/file"); n != 2 {
+		t.Errorf("origin got %d reads, want 2", n)
+	}
+	checkCached(t, c, "a/file", body)
+}
+
+func TestFillNoStore(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	provider := newStubProvider(map[string]stubFile{"a/file": {
+		body:   body,
+		header: http.Header{"Cache-Control": {"no-store"}},
+	}})
+	c := newTestCache(t, Configuration{}, provider)
+	halfway, resume := provider.gate()
+
+	w := newSignalingWriter(false)
+	done := make(chan *CacheError)
+	go func() { done <- readWith(c, "a/file", w) }()
+	<-halfway
+	f := runningFill(t, c, "a/file")
+	resume()
+	if cacheError := <-done; cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != body {
+		t.Errorf("got %d bytes, want %d", w.Body.Len(), len(body))
+	}
+	if f.waitDone() != nil {
+		t.Fatal("fill failed")
+	}
+	checkCached(t, c, "a/file", "")
+	checkNoTmpFiles(t, c)
+}
@@ -25,8 +25,8 @@ package main
 import (
 	"errors"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/alexandres/poormanscdn/client"
@@ -34,7 +34,23 @@ import (
 
 func CacheHandler(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (status int, err error) {
 	path := client.TrimPath(r.URL.Path)
-	q := r.URL.Query()
+	q, verified := r.URL.Query(), false
+	if q.Get("sig") == "" {
+		// a signed cookie stands in for the query, modified included. Browsers
+		// send one per matching cookie path, so use the first that verifies.
+		for _, cookie := range r.Cookies() {
+			if cookie.Name != client.SigCookieName {
+				continue
+			}
+			cookieQuery, err := url.ParseQuery(cookie.Value)
+			if err == nil && verifyRequestSig(config, path, cookieQuery, r) == nil {
+				q, verified = cookieQuery, true
+				// shared caches must not hand the response to clients without it
+				w.Header().Add("Vary", "Cookie")
+				break
+			}
+		}
+	}
 
 	lastModifiedAt := q.Get("modified")
 	lastModifiedAtInt, err := strconv.ParseInt(lastModifiedAt, 10, 64)
@@ -43,12 +59,10 @@ func CacheHandler(config Configuration, cache *Cache, w http.ResponseWriter, r *
 	}
 	lastModifiedAtTime := time.Unix(lastModifiedAtInt, 0)
 
-	if config.SigRequired {
-		host := strings.Split(r.RemoteAddr, ":")[0]
-		err = client.VerifySig(q.Get("sig"), config.Secret, path, lastModifiedAt, q.Get("expires"), q.Get("host"),
-			q.Get("domain"), host, r.Referer())
+	if config.SigRequired && !verified {
+		err = verifyRequestSig(config, path, q, r)
 		if err != nil {
-			return http.StatusForbidden, errors.New("bad sig")
+			return http.StatusForbidden, err
 		}
 	}
 
@@ -59,3 +73,44 @@ func CacheHandler(config Configuration, cache *Cache, w http.ResponseWriter, r *
 	}
 	return http.StatusOK, nil
 }
+
+// verifyRequestSig checks the signature fields q, from the query or a signed
+// cookie, of a request for path
+func verifyRequestSig(config Configuration, path string, q url.Values, r *http.Request) (err error) {
+	host := remoteHost(r.RemoteAddr)
+	secret := config.Secret
+	if kid := q.Get("kid"); kid != "" {
+		key, ok := client.FindKey(config.SigningKeys, kid)
+		if !ok {
+			return errors.New("unknown kid")
+		}
+		secret = key.Secret
+	} else if secret == "" {
+		return errors.New("missing kid")
+	}
+	switch q.Get("v") {
+	case client.SigV2:
+		if prefix := q.Get("prefix"); prefix != "" {
+			err = client.VerifySigV2Prefix(q.Get("sig"), secret, prefix, path, q.Get("modified"), q.Get("expires"), q.Get("host"),
+				q.Get("domain"), host, r.Referer())
+		} else {
+			err = client.VerifySigV2(q.Get("sig"), secret, path, q.Get("modified"), q.Get("expires"), q.Get("host"),
+				q.Get("domain"), host, r.Referer())
+		}
+	case "", client.SigV1:
+		if !config.AllowSigV1 {
+			return errors.New("v1 sig not allowed")
+		}
+		if q.Get("prefix") != "" {
+			return errors.New("prefix requires a v2 sig")
+		}
+		err = client.VerifySig(q.Get("sig"), secret, path, q.Get("modified"), q.Get("expires"), q.Get("host"),
+			q.Get("domain"), host, r.Referer())
+	default:
+		return errors.New("unknown sig version")
+	}
+	if err != nil {
+		return errors.New("bad sig")
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/alexandres/poormanscdn/client"
+)
+
+func TestVerifyRequestSigKeys(t *testing.T) {
+	keys := []client.SigningKey{
+		{ID: "old", Secret: "old-secret", VerifyOnly: true},
+		{ID: "new", Secret: "new-secret"},
+	}
+	tests := []struct {
+		name   string
+		config Configuration
+		kid    string
+		secret string
+		ok     bool
+	}{
+		{"current key", Configuration{SigningKeys: keys}, "new", "new-secret", true},
+		{"verify only key", Configuration{SigningKeys: keys}, "old", "old-secret", true},
+		{"unknown kid", Configuration{SigningKeys: keys}, "gone", "new-secret", false},
+		{"secret of another key", Configuration{SigningKeys: keys}, "new", "old-secret", false},
+		{"no kid without a secret", Configuration{SigningKeys: keys}, "", "new-secret", false},
+		{"legacy secret", Configuration{Secret: "legacy", SigningKeys: keys}, "", "legacy", true},
+		{"legacy secret without keys", Configuration{Secret: "legacy"}, "", "legacy", true},
+		{"key secret without kid", Configuration{Secret: "legacy", SigningKeys: keys}, "", "new-secret", false},
+		{"kid with the legacy secret", Configuration{Secret: "legacy", SigningKeys: keys}, "new", "legacy", false},
+	}
+	for _, test := range tests {
+		signedUrl, err := client.GetSignedUrlWithKey(test.kid, test.secret, "https://cdn.example.com", "a/file", "", "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := url.Parse(signedUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", signedUrl, nil)
+		err = verifyRequestSig(test.config, "a/file", parsed.Query(), r)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
+
+func TestCacheHandlerSigCookie(t *testing.T) {
+	c := newTestCache(t, Configuration{}, newStubProvider(map[string]stubFile{
+		"videos/a/file": {body: "aaa"},
+		"videos/b/file": {body: "bbb"},
+	}))
+	config := Configuration{Secret: "secret", SigRequired: true}
+	cookie, err := client.GetSignedPrefixCookie("secret", "videos/a/", "", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedUrl, err := client.GetSignedUrl("secret", "https://cdn.example.com", "videos/b/file", "", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		url    string
+		cookie *http.Cookie
+		status int
+		vary   bool
+	}{
+		{"cookie", "/videos/a/file", cookie, http.StatusOK, true},
+		// a rejected cookie leaves the request without modified
+		{"cookie of another prefix", "/videos/b/file", cookie, http.StatusBadRequest, false},
+		{"forged cookie", "/videos/a/file", &http.Cookie{Name: client.SigCookieName, Value: "modified=0&sig=bad&v=2"}, http.StatusBadRequest, false},
+		{"signed url", signedUrl, nil, http.StatusOK, false},
+		{"signed url along with a cookie", signedUrl, cookie, http.StatusOK, false},
+		{"bad sig along with a cookie", "/videos/a/file?modified=0&v=2&sig=bad", cookie, http.StatusForbidden, false},
+		{"neither", "/videos/a/file?modified=0", nil, http.StatusForbidden, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.cookie != nil {
+			r.AddCookie(test.cookie)
+		}
+		w := httptest.NewRecorder()
+		status, err := CacheHandler(config, c, w, r)
+		if status != test.status {
+			t.Errorf("%s: got %d (%v), want %d", test.name, status, err, test.status)
+		}
+		if vary := w.Header().Get("Vary") == "Cookie"; vary != test.vary {
+			t.Errorf("%s: got Vary %q", test.name, w.Header().Get("Vary"))
+		}
+	}
+}
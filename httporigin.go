@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type HTTPOriginClient struct {
+	httpClient *http.Client
+	originUrl  *url.URL
+	headers    map[string]string
+}
+
+func (c HTTPOriginClient) buildOriginUrl(path string) string {
+	url := *c.originUrl
+	url.Path = strings.TrimSuffix(url.Path, "/") + "/" + path
+	url.RawPath = ""
+	return url.String()
+}
+
+// do sends a request for path with OriginHeaders and optional extra headers
+func (c HTTPOriginClient) do(method string, path string, header http.Header) (*http.Response, *StorageProviderError) {
+	url := c.buildOriginUrl(path)
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, &StorageProviderError{http.StatusInternalServerError, err}
+	}
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return checkResponse(c.httpClient.Do(req))
+}
+
+func (c HTTPOriginClient) Stat(path string) (Stat, *StorageProviderError) {
+	res, storageProviderError := c.do("HEAD", path, nil)
+	if storageProviderError != nil {
+		return Stat{}, storageProviderError
+	}
+	res.Body.Close()
+	return statFromResponse(path, res), nil
+}
+
+func (c HTTPOriginClient) Read(path string, w *CacheWriter) *StorageProviderError {
+	res, storageProviderError := c.do("GET", path, nil)
+	if storageProviderError != nil {
+		return storageProviderError
+	}
+	return readResponse(path, res, w)
+}
+
+func (c HTTPOriginClient) ReadRange(path string, offset int64, length int64, version Stat, w *CacheWriter) *StorageProviderError {
+	res, storageProviderError := c.do("GET", path, rangeHeader(offset, length, version))
+	if storageProviderError != nil {
+		return storageProviderError
+	}
+	return readRangeResponse(path, res, version, w)
+}
+
+func GetHTTPOriginClient(config Configuration) (client HTTPOriginClient, err error) {
+	originUrl, err := url.Parse(config.OriginURL)
+	if err != nil {
+		return
+	}
+	if originUrl.Scheme != "http" && originUrl.Scheme != "https" {
+		err = errors.New("origin url must be http or https")
+		return
+	}
+	client = HTTPOriginClient{
+		httpClient: newOriginHTTPClient(config),
+		originUrl:  originUrl,
+		headers:    config.OriginHeaders,
+	}
+	return
+}
@@ -28,11 +28,57 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 	"unicode/utf8"
 )
 
+// LogFile is a log destination that can be switched to another file, or back
+// to its standard stream, while it is being written to
+type LogFile struct {
+	mu   sync.RWMutex
+	std  *os.File
+	file *os.File
+}
+
+var (
+	accessLog = &LogFile{std: os.Stdout}
+	errorLog  = &LogFile{std: os.Stderr}
+)
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.file != nil {
+		return l.file.Write(p)
+	}
+	return l.std.Write(p)
+}
+
+// Open switches l to path, or to its standard stream if path is empty. The
+// file is opened again even if l already writes to it so that rotated logs
+// are let go.
+func (l *LogFile) Open(path string) error {
+	var file *os.File
+	if path != "" {
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	old := l.file
+	l.file = file
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
 func WriteCombinedLog(w io.Writer, req *http.Request, url url.URL, ts time.Time, status int, size int64) {
 	buf := buildCommonLogLine(req, url, ts, status, size)
 	buf = append(buf, ` "`...)
@@ -24,6 +24,7 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -38,16 +39,33 @@ func httpError(w http.ResponseWriter, err error, code int) {
 }
 
 func main() {
-	config, err := GetConfiguration("config.json")
+	config, err := GetConfiguration(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = accessLog.Open(config.AccessLogFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = errorLog.Open(config.ErrorLogFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(errorLog)
+	log.Printf("configuration: %s", config)
+	evictionPolicy, err := GetEvictionPolicy(config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db, err := GetDatabase(config.DatabaseDir)
+	db, err := GetDatabase(config.DatabaseDir, evictionPolicy)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
-	storageClient := GetS3Client(config)
+	storageClient, err := GetStorageProvider(config)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -56,41 +74,134 @@ func main() {
 		log.Fatal(err)
 	}
 
+	RegisterCacheMetrics(cache)
 	go cache.FreeSpaceWatchdog()
 	cache.bytesUsedChan <- 0 // just to free space if needed on startup
+	if cache.negativeTTL > 0 {
+		go cache.NegativeCacheWatchdog()
+	}
+
+	live := NewLiveConfiguration(os.Args[1:], config, cache)
+	go live.ReloadOnSIGHUP()
 
 	http.HandleFunc("/robots.txt", makeHandler(
-		config,
+		live,
 		cache,
 		func(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (int, error) {
 			fmt.Fprint(w, "User-agent: *\nDisallow: /")
 			return http.StatusOK, nil
 		}))
 	http.HandleFunc("/favicon.ico", makeHandler(
-		config,
+		live,
 		cache,
 		func(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (int, error) {
 			return http.StatusNotFound, errors.New("not found")
 		}))
 
-	http.HandleFunc("/", makeHandler(config, cache, CacheHandler))
-	log.Fatal(http.ListenAndServe(config.Listen, nil))
+	http.HandleFunc("/", makeHandler(live, cache, CacheHandler))
+
+	if config.AdminListen != "" {
+		go func() {
+			log.Fatal(ServeAdmin(live, cache))
+		}()
+	}
+
+	acmeManager := GetACMEManager(config)
+	if config.TLSListen != "" {
+		tlsListener, err := Listen(live, config.TLSListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(ServeTLS(config, tlsListener, http.DefaultServeMux, acmeManager))
+		}()
+	}
+
+	listener, err := Listen(live, config.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(http.Serve(listener, HTTPHandler(config, http.DefaultServeMux, acmeManager)))
+}
+
+func makeHandler(live *LiveConfiguration, cache *Cache, handler func(Configuration, *Cache, http.ResponseWriter, *http.Request) (int, error)) func(http.ResponseWriter, *http.Request) {
+	return handleRequests(live, cache, handler, true)
 }
 
-func makeHandler(config Configuration, cache *Cache, handler func(Configuration, *Cache, http.ResponseWriter, *http.Request) (int, error)) func(http.ResponseWriter, *http.Request) {
+// handleRequests serves requests with handler, counting the responses in
+// responses_total if counted is set
+func handleRequests(live *LiveConfiguration, cache *Cache, handler func(Configuration, *Cache, http.ResponseWriter, *http.Request) (int, error), counted bool) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		status, err := handler(config, cache, w, r)
+		state := live.load()
+		config := state.config
+		r.RemoteAddr = clientAddr(state.trustedProxies, r)
+		response := &responseWriter{ResponseWriter: w}
+		status, err := handler(config, cache, response, r)
+		aborted := false
 		if status != http.StatusOK {
-			if w.Header().Get("Content-Length") == "" { // response not yet sent, ok to write to repsonse
-				WriteResponseError(os.Stderr, w, r, status, err)
-			} else if status == http.StatusInternalServerError {
-				WriteError(os.Stderr, r, time.Now(), status, err) // don't write to response
+			if !response.started {
+				WriteResponseError(errorLog, w, r, status, err)
+			} else {
+				// the client already got a status and maybe part of the body,
+				// cut the connection so that it can't take it for complete
+				aborted = true
+				if status >= http.StatusInternalServerError {
+					WriteError(errorLog, r, time.Now(), status, err)
+				}
 			}
 		}
-		WriteCombinedLog(os.Stdout, r, *r.URL, time.Now(), status, getContentLength(w))
+		if response.started && !aborted {
+			// e.g. 206 or 304 written by http.ServeContent for a handler
+			// returning 200
+			status = response.status
+		}
+		if counted {
+			responses.WithLabelValues(strconv.Itoa(status)).Inc()
+		}
+		WriteCombinedLog(accessLog, r, *r.URL, time.Now(), status, getContentLength(w))
+		if aborted {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// responseWriter records whether the response was started, after which errors
+// can no longer be sent to the client, and with which status
+type responseWriter struct {
+	http.ResponseWriter
+	started bool
+	status  int
+}
+
+// start records status unless the response was already started
+func (w *responseWriter) start(status int) {
+	if !w.started {
+		w.started = true
+		w.status = status
+	}
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.start(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.start(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.start(http.StatusOK)
+		flusher.Flush()
 	}
 }
 
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func getContentLength(w http.ResponseWriter) int64 {
 	contentLength, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
 	if err != nil {
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "poormanscdn"
+
+// results of cache lookups counted by cacheLookups
+const (
+	cacheHit      = "hit"
+	cacheMiss     = "miss"
+	cacheStale    = "stale"
+	cacheNegative = "negative"
+)
+
+var (
+	responses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "responses_total",
+		Help:      "Responses by status code.",
+	}, []string{"code"})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lookups_total",
+		Help:      "Lookups of files and slices by result: hit, miss, stale or negative.",
+	}, []string{"result"})
+	originDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "origin_request_duration_seconds",
+		Help:      "Duration of requests to origin, including downloading the response.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"operation"})
+	originErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "origin_errors_total",
+		Help:      "Failed requests to origin by status code.",
+	}, []string{"operation", "code"})
+	evictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "evictions_total",
+		Help:      "Files and slices evicted to free space.",
+	})
+	evictionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "eviction_duration_seconds",
+		Help:      "Duration of freeing space when the cache is full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(responses, cacheLookups, originDuration, originErrors, evictions, evictionDuration)
+}
+
+// RegisterCacheMetrics exports the counters kept by cache
+func RegisterCacheMetrics(cache *Cache) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_in_total",
+			Help:      "Bytes downloaded from origin into the cache.",
+		}, func() float64 { return float64(atomic.LoadUint64(&cache.bytesIn)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_out_total",
+			Help:      "Bytes served from the cache.",
+		}, func() float64 { return float64(atomic.LoadUint64(&cache.bytesOut)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_bytes_in_use",
+			Help:      "Bytes used by cached files.",
+		}, func() float64 { return float64(atomic.LoadUint64(&cache.bytesInUse)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "fills_in_flight",
+			Help:      "Files and slices being downloaded from origin.",
+		}, func() float64 {
+			cache.fillsMu.Lock()
+			defer cache.fillsMu.Unlock()
+			return float64(len(cache.fills))
+		}),
+	)
+}
+
+var metricsHandler = promhttp.Handler()
+
+// MetricsHandler serves metrics in the Prometheus text format (GET /metrics)
+func MetricsHandler(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (int, error) {
+	metricsHandler.ServeHTTP(w, r)
+	return http.StatusOK, nil
+}
+
+// observeOrigin records the duration and outcome of a request to origin
+// started at startedAt
+func observeOrigin(operation string, startedAt time.Time, storageProviderError *StorageProviderError) {
+	originDuration.WithLabelValues(operation).Observe(time.Since(startedAt).Seconds())
+	if storageProviderError != nil {
+		originErrors.WithLabelValues(operation, strconv.Itoa(storageProviderError.status)).Inc()
+	}
+}
+
+// instrumentedStorageProvider measures the requests a storage provider sends
+// to origin
+type instrumentedStorageProvider struct {
+	StorageProvider
+}
+
+func (p instrumentedStorageProvider) Read(path string, w *CacheWriter) *StorageProviderError {
+	startedAt := time.Now()
+	storageProviderError := p.StorageProvider.Read(path, w)
+	observeOrigin("read", startedAt, storageProviderError)
+	return storageProviderError
+}
+
+func (p instrumentedStorageProvider) ReadRange(path string, offset int64, length int64, version Stat, w *CacheWriter) *StorageProviderError {
+	startedAt := time.Now()
+	storageProviderError := p.StorageProvider.ReadRange(path, offset, length, version, w)
+	observeOrigin("read_range", startedAt, storageProviderError)
+	return storageProviderError
+}
+
+func (p instrumentedStorageProvider) Stat(path string) (Stat, *StorageProviderError) {
+	startedAt := time.Now()
+	stat, storageProviderError := p.StorageProvider.Stat(path)
+	observeOrigin("stat", startedAt, storageProviderError)
+	return stat, storageProviderError
+}
+
+type instrumentedStorageLister struct {
+	instrumentedStorageProvider
+	lister StorageLister
+}
+
+func (p instrumentedStorageLister) List(prefix string) ([]string, *StorageProviderError) {
+	startedAt := time.Now()
+	paths, storageProviderError := p.lister.List(prefix)
+	observeOrigin("list", startedAt, storageProviderError)
+	return paths, storageProviderError
+}
+
+// instrumentStorageProvider wraps storageProvider so that its requests to
+// origin are measured, keeping it a StorageLister if it is one
+func instrumentStorageProvider(storageProvider StorageProvider) StorageProvider {
+	instrumented := instrumentedStorageProvider{storageProvider}
+	if lister, ok := storageProvider.(StorageLister); ok {
+		return instrumentedStorageLister{instrumented, lister}
+	}
+	return instrumented
+}
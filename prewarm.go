@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Prewarm fetches path into the cache through the same fills as client
+// requests, without serving it to anyone. Files already cached are left alone.
+func (c *Cache) Prewarm(path string) *CacheError {
+	path, cacheError := cleanPath(path)
+	if cacheError != nil {
+		return cacheError
+	}
+	_, err := os.Stat(c.buildCachePath(path))
+	if err == nil {
+		return nil
+	}
+	_, err = DeleteMissingFile(c.db, path)
+	if err != nil {
+		return &CacheError{http.StatusInternalServerError, err}
+	}
+
+	if c.sliceSize > 0 {
+		record, sliced, cacheError := c.sliceRecord(path, time.Time{}, nil)
+		if cacheError != nil {
+			return cacheError
+		}
+		if sliced {
+			slices := (int64(record.SizeInBytes) + c.sliceSize - 1) / c.sliceSize
+			for index := int64(0); index < slices; index++ {
+				s, cacheError := c.openSlice(path, record, index)
+				if cacheError != nil {
+					return cacheError
+				}
+				var storageProviderError *StorageProviderError
+				if s.fill != nil {
+					storageProviderError = s.fill.waitDone()
+				}
+				s.Close()
+				if storageProviderError != nil {
+					return &CacheError{storageProviderError.status, storageProviderError}
+				}
+			}
+			return nil
+		}
+	}
+
+	fill, file, err := c.joinFileFill(path)
+	if err != nil {
+		return &CacheError{http.StatusInternalServerError, err}
+	}
+	file.Close()
+	storageProviderError := fill.waitDone()
+	if storageProviderError != nil {
+		return &CacheError{storageProviderError.status, storageProviderError}
+	}
+	return nil
+}
+
+type PrewarmRequest struct {
+	Paths  []string
+	Prefix string
+}
+
+type PrewarmProgress struct {
+	Path   string
+	Status int
+	Error  string `json:",omitempty"`
+}
+
+type PrewarmSummary struct {
+	Done   int
+	Failed int
+}
+
+// PrewarmHandler fills the cache with the paths listed in the request body
+// (POST /prewarm with {"Paths": ["some/file.ext"]}) and, for storage providers
+// that can list files, with every file under a prefix ({"Prefix": "some/dir/"}).
+// At most PrewarmConcurrency paths are fetched at once. Progress is streamed
+// as one JSON object per line per path, followed by a summary.
+func PrewarmHandler(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errors.New("prewarm requires POST")
+	}
+	var prewarmRequest PrewarmRequest
+	err := json.NewDecoder(r.Body).Decode(&prewarmRequest)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	paths := prewarmRequest.Paths
+	if prewarmRequest.Prefix != "" {
+		lister, ok := cache.storageProvider.(StorageLister)
+		if !ok {
+			return http.StatusBadRequest, errors.New("storage backend can't list files")
+		}
+		listed, storageProviderError := lister.List(prewarmRequest.Prefix)
+		if storageProviderError != nil {
+			return storageProviderError.status, storageProviderError
+		}
+		paths = append(paths, listed...)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	summary := PrewarmSummary{}
+	semaphore := make(chan struct{}, config.PrewarmConcurrency)
+	for _, path := range paths {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(path string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			progress := PrewarmProgress{Path: path, Status: http.StatusOK}
+			cacheError := cache.Prewarm(path)
+			if cacheError != nil {
+				progress.Status = cacheError.status
+				progress.Error = cacheError.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if cacheError != nil {
+				summary.Failed++
+			} else {
+				summary.Done++
+			}
+			encoder.Encode(progress)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}(path)
+	}
+	wg.Wait()
+	encoder.Encode(summary)
+	return http.StatusOK, nil
+}
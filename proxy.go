@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseNets parses a list of IP addresses and CIDR ranges such as
+// 10.0.0.0/8 or 2001:db8::/32
+func parseNets(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, elem := range list {
+		if _, ipNet, err := net.ParseCIDR(elem); err == nil {
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(elem)
+		if ip == nil {
+			return nil, errors.New("bad address or range " + elem)
+		}
+		bits := 8 * len(ip)
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost strips the port, if any, from addr, e.g. [2001:db8::1]:443
+// gives 2001:db8::1
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// clientAddr returns the remote address of r or, if it is one of the trusted
+// proxies, the address of the client the proxies forwarded r for, which is
+// the last address in the Forwarded or X-Forwarded-For header that is not a
+// trusted proxy itself
+func clientAddr(trusted []*net.IPNet, r *http.Request) string {
+	if !containsIP(trusted, net.ParseIP(remoteHost(r.RemoteAddr))) {
+		return r.RemoteAddr
+	}
+	addr := r.RemoteAddr
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		// unknown or obfuscated addresses end the chain at the proxy that saw them
+		ip := net.ParseIP(remoteHost(hops[i]))
+		if ip == nil {
+			break
+		}
+		addr = ip.String()
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the addresses, client first, that the for parameters
+// of the Forwarded header or, without one, the X-Forwarded-For header give
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	if forwarded := header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				nameValue := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(nameValue) == 2 && strings.EqualFold(nameValue[0], "for") {
+					hop = strings.Trim(nameValue[1], `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// proxyProtocolTimeout bounds the time a trusted proxy takes to send the
+// PROXY protocol header of a connection
+const proxyProtocolTimeout = 10 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listen listens on addr and, if ProxyProtocol is set, takes the remote
+// address of connections from TrustedProxies from their PROXY protocol header
+func Listen(live *LiveConfiguration, addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || !live.Load().ProxyProtocol {
+		return listener, err
+	}
+	return proxyProtocolListener{listener, live}, nil
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	live *LiveConfiguration
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	trusted := l.live.load().trustedProxies
+	if !containsIP(trusted, net.ParseIP(remoteHost(conn.RemoteAddr().String()))) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the header on first use rather than in Accept, so
+// that a slow proxy doesn't hold up other connections
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		addr, err := readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("bad proxy protocol header from %s: %s", c.remoteAddr, err)
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remoteAddr = addr
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// Write fails on connections with a bad header, so that nothing, not even an
+// error response, is sent back before they are closed
+func (c *proxyProtocolConn) Write(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
+
+// readProxyProtocolHeader reads a PROXY protocol v1 or v2 header and returns
+// the source address it gives, nil if it gives none (e.g. health checks of
+// the proxy). A connection that doesn't start with a header is an error, its
+// requests would otherwise be taken for the proxy's own.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(start) == "PROXY" {
+		return readProxyProtocolV1(r)
+	}
+	if bytes.Equal(start, proxyProtocolV2Signature[:5]) {
+		return readProxyProtocolV2(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readProxyProtocolV1 reads a header such as
+// "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("bad v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("bad v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("bad v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads a binary header, skipping its TLVs
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		return nil, errors.New("bad v2 header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	switch header[12] & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errors.New("bad v2 command")
+	}
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := parseNets([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		xForwardedFor string
+		forwarded     string
+		want          string
+	}{
+		{"direct client", "203.0.113.7:5000", "", "", "203.0.113.7:5000"},
+		{"spoofed by an untrusted peer", "203.0.113.7:5000", "198.51.100.1", `for=198.51.100.1`, "203.0.113.7:5000"},
+		{"trusted proxy without header", "10.0.0.1:5000", "", "", "10.0.0.1:5000"},
+		{"trusted proxy", "10.0.0.1:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed through a trusted proxy", "10.0.0.1:5000", "192.0.2.66, 198.51.100.1", "", "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:5000", "198.51.100.1, 10.1.1.1, 10.2.2.2", "", "198.51.100.1"},
+		{"only trusted proxies", "10.0.0.1:5000", "10.3.3.3", "", "10.3.3.3"},
+		{"garbage", "10.0.0.1:5000", "not-an-ip", "", "10.0.0.1:5000"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:5000", "2001:db8::cafe", "", "2001:db8::cafe"},
+		{"untrusted IPv6 peer", "[2001:db8::2]:5000", "198.51.100.1", "", "[2001:db8::2]:5000"},
+		{"Forwarded", "10.0.0.1:5000", "", `for=198.51.100.1;proto=https`, "198.51.100.1"},
+		{"Forwarded over X-Forwarded-For", "10.0.0.1:5000", "192.0.2.66", `for=198.51.100.1`, "198.51.100.1"},
+		{"Forwarded quoted IPv6 with port", "10.0.0.1:5000", "", `for="[2001:db8::cafe]:4711";proto=https, for=10.2.2.2`, "2001:db8::cafe"},
+		{"Forwarded quoted IPv6", "10.0.0.1:5000", "", `For="[2001:db8::cafe]"`, "2001:db8::cafe"},
+		{"Forwarded unknown", "10.0.0.1:5000", "", `for=unknown, for=10.2.2.2`, "10.2.2.2"},
+		{"Forwarded obfuscated", "10.0.0.1:5000", "", `for=_hidden, for=198.51.100.1`, "198.51.100.1"},
+		{"Forwarded without for", "10.0.0.1:5000", "", `proto=https`, "10.0.0.1:5000"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.xForwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.xForwardedFor)
+		}
+		if test.forwarded != "" {
+			r.Header.Set("Forwarded", test.forwarded)
+		}
+		if got := clientAddr(trusted, r); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+		if got := clientAddr(nil, r); got != test.remoteAddr {
+			t.Errorf("%s: got %s without trusted proxies", test.name, got)
+		}
+	}
+}
+
+// proxyV2Header builds a PROXY protocol v2 header
+func proxyV2Header(command byte, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+func proxyV2Address(source net.IP, port uint16) []byte {
+	ip := source.To4()
+	if ip == nil {
+		ip = source.To16()
+	}
+	body := make([]byte, 2*len(ip)+4)
+	copy(body, ip)
+	binary.BigEndian.PutUint16(body[2*len(ip):], port)
+	return body
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4 := proxyV2Address(net.ParseIP("198.51.100.9"), 4242)
+	ipv6 := proxyV2Address(net.ParseIP("2001:db8::9"), 4242)
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // empty if the header gives no address
+		err    bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n"), "203.0.113.7:56324", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n"), "[2001:db8::7]:56324", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN 203.0.113.7 192.0.2.1 56324 443\r\n"), "", false},
+		{"v1 truncated", []byte("PROXY TCP4 203.0.113.7"), "", true},
+		{"v1 without CR", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\n"), "", true},
+		{"v1 bad protocol", []byte("PROXY UDP4 203.0.113.7 192.0.2.1 56324 443\r\n"), "", true},
+		{"v1 bad address", []byte("PROXY TCP4 203.0.113 192.0.2.1 56324 443\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 99999 443\r\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n"), "", true},
+		{"v2 IPv4", proxyV2Header(1, 1, ipv4), "198.51.100.9:4242", false},
+		{"v2 IPv6", proxyV2Header(1, 2, ipv6), "[2001:db8::9]:4242", false},
+		{"v2 IPv4 with TLVs", proxyV2Header(1, 1, append(ipv4, 0x04, 0, 1, 'x')), "198.51.100.9:4242", false},
+		{"v2 LOCAL", proxyV2Header(0, 0, nil), "", false},
+		{"v2 unspecified family", proxyV2Header(1, 0, nil), "", false},
+		{"v2 bad command", proxyV2Header(2, 1, ipv4), "", true},
+		{"v2 short IPv4 address", proxyV2Header(1, 1, ipv4[:8]), "", true},
+		{"v2 short IPv6 address", proxyV2Header(1, 2, ipv6[:20]), "", true},
+		{"v2 truncated header", proxyV2Header(1, 1, ipv4)[:14], "", true},
+		{"v2 truncated body", proxyV2Header(1, 1, ipv4)[:20], "", true},
+		{"v2 bad version", append(append([]byte{}, proxyProtocolV2Signature...), 0x11, 0x11, 0, 0), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", true},
+		{"empty", nil, "", true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(bytes.NewReader(append(test.header, "GET"...)))
+		addr, err := readProxyProtocolHeader(r)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "GET" {
+			t.Errorf("%s: header not consumed, %q left", test.name, rest)
+		}
+	}
+}
+
+// serveWithProxyProtocol serves the remote address of requests on a listener
+// taking client addresses from PROXY protocol headers of trusted peers
+func serveWithProxyProtocol(t *testing.T, trustedProxies []string) string {
+	live := NewLiveConfiguration(nil, Configuration{ProxyProtocol: true, TrustedProxies: trustedProxies}, nil)
+	listener, err := Listen(live, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+	return listener.Addr().String()
+}
+
+// remoteAddrVia sends a request after header and returns the remote address
+// the server saw, or an error if the connection was closed
+func remoteAddrVia(addr string, header []byte) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(header)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: cdn\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	trusted := serveWithProxyProtocol(t, []string{"127.0.0.1"})
+	got, err := remoteAddrVia(trusted, []byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n"))
+	if err != nil || got != "203.0.113.7:56324" {
+		t.Errorf("got %q %v, want the address from the header", got, err)
+	}
+	got, err = remoteAddrVia(trusted, proxyV2Header(0, 0, nil))
+	if err != nil || !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("got %q %v, want the proxy's address for LOCAL", got, err)
+	}
+	if got, err = remoteAddrVia(trusted, nil); err == nil {
+		t.Errorf("trusted connection without header served as %q", got)
+	}
+
+	untrusted := serveWithProxyProtocol(t, []string{"10.0.0.1"})
+	if got, err = remoteAddrVia(untrusted, nil); err != nil || !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("got %q %v for an untrusted connection", got, err)
+	}
+	if got, _ = remoteAddrVia(untrusted, []byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n")); got == "203.0.113.7:56324" {
+		t.Errorf("header of an untrusted connection trusted")
+	}
+}
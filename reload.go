@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// LiveConfiguration holds the configuration handlers are given, which Reload
+// replaces as a whole. Only fields tagged reloadable change on reload, the
+// others keep the values the program started with.
+type LiveConfiguration struct {
+	args  []string
+	cache *Cache
+	mu    sync.Mutex // serializes reloads
+	state atomic.Value
+}
+
+// liveState is what LiveConfiguration replaces on reload, the configuration
+// along with what is parsed from it once rather than on every request
+type liveState struct {
+	config         Configuration
+	trustedProxies []*net.IPNet
+}
+
+func NewLiveConfiguration(args []string, config Configuration, cache *Cache) *LiveConfiguration {
+	live := &LiveConfiguration{args: args, cache: cache}
+	live.store(config)
+	return live
+}
+
+func (live *LiveConfiguration) store(config Configuration) {
+	// validateConfiguration already rejected bad TrustedProxies
+	trustedProxies, _ := parseNets(config.TrustedProxies)
+	live.state.Store(liveState{config, trustedProxies})
+}
+
+func (live *LiveConfiguration) load() liveState {
+	return live.state.Load().(liveState)
+}
+
+func (live *LiveConfiguration) Load() Configuration {
+	return live.load().config
+}
+
+// Reload reads the configuration again from the same file, environment and
+// flags and applies it. An invalid configuration is rejected, leaving the
+// running one untouched.
+func (live *LiveConfiguration) Reload() (Configuration, error) {
+	config, err := live.reload()
+	if err != nil {
+		log.Printf("configuration not reloaded: %s", err)
+	}
+	return config, err
+}
+
+func (live *LiveConfiguration) reload() (Configuration, error) {
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	current := live.Load()
+	config, err := GetConfiguration(live.args)
+	if err != nil {
+		return current, err
+	}
+
+	currentFields := reflect.ValueOf(current)
+	fields := reflect.ValueOf(&config).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		if field.Tag.Get("reloadable") == "true" {
+			continue
+		}
+		if !reflect.DeepEqual(fields.Field(i).Interface(), currentFields.Field(i).Interface()) {
+			log.Printf("%s changed, restart to apply it", field.Name)
+			fields.Field(i).Set(currentFields.Field(i))
+		}
+	}
+	err = validateConfiguration(&config)
+	if err != nil {
+		return current, err
+	}
+
+	err = accessLog.Open(config.AccessLogFile)
+	if err != nil {
+		return current, err
+	}
+	err = errorLog.Open(config.ErrorLogFile)
+	if err != nil {
+		accessLog.Open(current.AccessLogFile)
+		return current, err
+	}
+	live.store(config)
+	if config.CacheSize != current.CacheSize || config.FreeSpaceBatchSizeInBytes != current.FreeSpaceBatchSizeInBytes {
+		live.cache.Resize(config.CacheSize, config.FreeSpaceBatchSizeInBytes)
+	}
+	log.Printf("configuration reloaded: %s", config)
+	return config, nil
+}
+
+// ReloadOnSIGHUP reloads the configuration whenever the process gets a SIGHUP
+func (live *LiveConfiguration) ReloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		live.Reload()
+	}
+}
+
+// ReloadHandler reloads the configuration (POST /reload)
+func (live *LiveConfiguration) ReloadHandler(config Configuration, cache *Cache, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errors.New("reload requires POST")
+	}
+	_, err := live.Reload()
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	return writeJSON(w, map[string]bool{"Reloaded": true})
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{
+		"Listen": ":8080",
+		"StorageBackend": "filesystem",
+		"FilesystemRoot": "/srv/a",
+		"TrustedProxies": ["10.0.0.0/8"],
+		"AdminToken": "old",
+		"CacheSize": 1000
+	}`)
+	args := []string{"-config", configPath}
+	config, err := GetConfiguration(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCache(t, config, newStubProvider(nil))
+	live := NewLiveConfiguration(args, config, c)
+
+	writeConfig(`{
+		"Listen": ":9090",
+		"StorageBackend": "filesystem",
+		"FilesystemRoot": "/srv/b",
+		"TrustedProxies": ["192.0.2.0/24"],
+		"AdminToken": "new",
+		"CacheSize": 2000
+	}`)
+	reloaded, err := live.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := live.Load(); got.AdminToken != reloaded.AdminToken {
+		t.Errorf("reloaded configuration not stored")
+	}
+	// reloadable
+	if reloaded.AdminToken != "new" {
+		t.Errorf("got admin token %q, want new", reloaded.AdminToken)
+	}
+	if len(reloaded.TrustedProxies) != 1 || reloaded.TrustedProxies[0] != "192.0.2.0/24" {
+		t.Errorf("got trusted proxies %v", reloaded.TrustedProxies)
+	}
+	if reloaded.CacheSize != 2000 || atomic.LoadUint64(&c.cacheSize) != 2000 {
+		t.Errorf("got cache size %d, %d in the cache, want 2000", reloaded.CacheSize, atomic.LoadUint64(&c.cacheSize))
+	}
+	// not reloadable
+	if reloaded.Listen != ":8080" {
+		t.Errorf("got listen %q, want the old :8080", reloaded.Listen)
+	}
+	if reloaded.FilesystemRoot != "/srv/a" {
+		t.Errorf("got filesystem root %q, want the old /srv/a", reloaded.FilesystemRoot)
+	}
+	// trusted proxies are parsed again
+	trusted := func(ip string) bool {
+		for _, ipNet := range live.load().trustedProxies {
+			if ipNet.Contains(net.ParseIP(ip)) {
+				return true
+			}
+		}
+		return false
+	}
+	if !trusted("192.0.2.1") || trusted("10.0.0.1") {
+		t.Errorf("got trusted proxies %v, want 192.0.2.0/24 only", live.load().trustedProxies)
+	}
+
+	// an invalid configuration leaves the running one untouched
+	writeConfig(`{"StorageBackend": "filesystem", "FilesystemRoot": "/srv/a", "TrustedProxies": ["bad"], "AdminToken": "newer"}`)
+	if _, err = live.Reload(); err == nil {
+		t.Errorf("bad trusted proxies reloaded")
+	}
+	if got := live.Load().AdminToken; got != "new" {
+		t.Errorf("got admin token %q after a failed reload, want new", got)
+	}
+	if !trusted("192.0.2.1") {
+		t.Errorf("trusted proxies changed by a failed reload")
+	}
+}
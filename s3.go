@@ -23,60 +23,161 @@
 package main
 
 import (
+	"encoding/xml"
 	"errors"
-	"fmt"
-	"github.com/kr/s3"
-	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
+const defaultS3Region = "us-east-1"
+
 type S3Client struct {
-	bucket    string
-	accessKey string
-	secretKey string
+	httpClient *http.Client
+	bucket     string
+	keys       S3Keys
+	endpoint   *url.URL
+	pathStyle  bool
 }
 
-func (c S3Client) buildS3Url(path string) string {
-	url, _ := url.Parse("http://" + c.bucket + ".s3.amazonaws.com/")
-	url.Path = path
-	return url.String()
+func (c S3Client) buildS3Url(path string) *url.URL {
+	url := *c.endpoint
+	if c.pathStyle {
+		url.Path = "/" + c.bucket + "/" + path
+	} else {
+		url.Host = c.bucket + "." + url.Host
+		url.Path = "/" + path
+	}
+	url.RawPath = s3EscapePath(url.Path)
+	return &url
 }
 
-func (c S3Client) Read(path string, w *CacheWriter) *StorageProviderError {
-	url := c.buildS3Url(path)
-	req, err := http.NewRequest("GET", url, nil)
+// do sends a signed request for the object at path with optional extra headers
+func (c S3Client) do(method string, path string, header http.Header) (*http.Response, *StorageProviderError) {
+	return c.doUrl(method, c.buildS3Url(path), header)
+}
+
+func (c S3Client) doUrl(method string, url *url.URL, header http.Header) (*http.Response, *StorageProviderError) {
+	req, err := http.NewRequest(method, "", nil)
 	if err != nil {
-		return &StorageProviderError{http.StatusInternalServerError, err}
+		return nil, &StorageProviderError{http.StatusInternalServerError, err}
 	}
-	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-	s3.Sign(req, s3.Keys{
-		AccessKey: c.accessKey,
-		SecretKey: c.secretKey,
-	})
-	client := http.DefaultClient
-	res, err := client.Do(req)
-	if err != nil {
-		return &StorageProviderError{http.StatusServiceUnavailable, err}
+	req.URL = url
+	req.Host = req.URL.Host
+	for name, values := range header {
+		req.Header[name] = values
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		err = errors.New(fmt.Sprintf("status code: %d", res.StatusCode))
-		return &StorageProviderError{res.StatusCode, err}
+	if c.keys.AccessKey != "" {
+		SignV4(req, c.keys, time.Now())
 	}
-	w.WriteSize(res.ContentLength)
-	_, err = io.Copy(w, res.Body)
-	if err != nil {
-		return &StorageProviderError{http.StatusRequestTimeout, err}
+	return checkResponse(c.httpClient.Do(req))
+}
+
+func (c S3Client) Stat(path string) (Stat, *StorageProviderError) {
+	res, storageProviderError := c.do("HEAD", path, nil)
+	if storageProviderError != nil {
+		return Stat{}, storageProviderError
+	}
+	res.Body.Close()
+	return statFromResponse(path, res), nil
+}
+
+func (c S3Client) Read(path string, w *CacheWriter) *StorageProviderError {
+	res, storageProviderError := c.do("GET", path, nil)
+	if storageProviderError != nil {
+		return storageProviderError
+	}
+	return readResponse(path, res, w)
+}
+
+func (c S3Client) ReadRange(path string, offset int64, length int64, version Stat, w *CacheWriter) *StorageProviderError {
+	res, storageProviderError := c.do("GET", path, rangeHeader(offset, length, version))
+	if storageProviderError != nil {
+		return storageProviderError
+	}
+	return readRangeResponse(path, res, version, w)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns the keys under prefix using ListObjectsV2
+func (c S3Client) List(prefix string) (paths []string, storageProviderError *StorageProviderError) {
+	continuationToken := ""
+	for {
+		listUrl := c.buildS3Url("")
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if continuationToken != "" {
+			q.Set("continuation-token", continuationToken)
+		}
+		listUrl.RawQuery = q.Encode()
+		res, storageProviderError := c.doUrl("GET", listUrl, nil)
+		if storageProviderError != nil {
+			return nil, storageProviderError
+		}
+		var result listBucketResult
+		err := xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, &StorageProviderError{http.StatusBadGateway, err}
+		}
+		for _, object := range result.Contents {
+			if !strings.HasSuffix(object.Key, "/") {
+				paths = append(paths, object.Key)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return paths, nil
+		}
+		continuationToken = result.NextContinuationToken
 	}
-	return nil
 }
 
-func GetS3Client(config Configuration) S3Client {
-	return S3Client{
-		bucket:    config.S3Bucket,
-		accessKey: config.S3AccessKey,
-		secretKey: config.S3SecretKey,
+// GetS3Client builds a client for AWS S3 or, when S3Endpoint is set, for an
+// S3 compatible store such as MinIO or Ceph RGW
+func GetS3Client(config Configuration) (client S3Client, err error) {
+	region := config.S3Region
+	if region == "" {
+		region = defaultS3Region
+	}
+	endpoint := config.S3Endpoint
+	if endpoint == "" {
+		endpoint = "s3." + region + ".amazonaws.com"
+		if region == defaultS3Region {
+			endpoint = "s3.amazonaws.com"
+		}
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+	if endpointUrl.Scheme != "http" && endpointUrl.Scheme != "https" {
+		err = errors.New("s3 endpoint must be http or https")
+		return
+	}
+	endpointUrl.Path = ""
+	client = S3Client{
+		httpClient: newOriginHTTPClient(config),
+		bucket:     config.S3Bucket,
+		keys: S3Keys{
+			AccessKey: config.S3AccessKey,
+			SecretKey: config.S3SecretKey,
+			Region:    region,
+		},
+		endpoint: endpointUrl,
+		// bucket names with dots break TLS certificates of virtual-hosted URLs
+		pathStyle: config.S3PathStyle || (endpointUrl.Scheme == "https" && strings.Contains(config.S3Bucket, ".")),
 	}
+	return
 }
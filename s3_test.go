@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Stub is a minimal S3 compatible server, like MinIO, for a single bucket.
+// It checks the SigV4 signature of every request by signing it again.
+type s3Stub struct {
+	bucket   string
+	keys     S3Keys
+	objects  map[string]string
+	pageSize int
+	server   *httptest.Server
+
+	mu       sync.Mutex
+	styles   []string
+	listings int
+}
+
+func newS3Stub(t *testing.T, objects map[string]string) *s3Stub {
+	stub := &s3Stub{
+		bucket:   "bucket",
+		keys:     S3Keys{AccessKey: "minio", SecretKey: "minio123", Region: "eu-west-3"},
+		objects:  objects,
+		pageSize: 2,
+	}
+	stub.server = httptest.NewServer(stub)
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+// client returns an S3Client for the stub at endpoint s3.test, which every
+// connection is routed to, so that virtual-hosted URLs resolve too
+func (s *s3Stub) client(t *testing.T, pathStyle bool) S3Client {
+	client, err := GetS3Client(Configuration{
+		S3Bucket:    s.bucket,
+		S3AccessKey: s.keys.AccessKey,
+		S3SecretKey: s.keys.SecretKey,
+		S3Region:    s.keys.Region,
+		S3Endpoint:  "http://s3.test",
+		S3PathStyle: pathStyle,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.server.Listener.Addr().String()
+	client.httpClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	return client
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.signedCorrectly(r) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	host := strings.Split(r.Host, ":")[0]
+	var key, style string
+	if host == s.bucket+".s3.test" {
+		key, style = strings.TrimPrefix(r.URL.Path, "/"), "virtual-hosted"
+	} else if host == "s3.test" && strings.HasPrefix(r.URL.Path, "/"+s.bucket+"/") {
+		key, style = strings.TrimPrefix(r.URL.Path, "/"+s.bucket+"/"), "path"
+	} else {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	s.styles = append(s.styles, style)
+	s.mu.Unlock()
+	if r.URL.Query().Get("list-type") == "2" {
+		s.list(w, r)
+		return
+	}
+	content, ok := s.objects[key]
+	if !ok {
+		http.Error(w, "NoSuchKey", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum([]byte(content))))
+	http.ServeContent(w, r, key, time.Unix(1500000000, 0), strings.NewReader(content))
+}
+
+func (s *s3Stub) signedCorrectly(r *http.Request) bool {
+	date, err := time.Parse(sigV4DateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.RequestURI, nil)
+	if err != nil {
+		return false
+	}
+	if rangeValue := r.Header.Get("Range"); rangeValue != "" {
+		req.Header.Set("Range", rangeValue)
+	}
+	SignV4(req, s.keys, date)
+	return req.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+// list answers ListObjectsV2 requests, pageSize keys at a time
+func (s *s3Stub) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.listings++
+	s.mu.Unlock()
+	q := r.URL.Query()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, q.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(q.Get("continuation-token"))
+	end := start + s.pageSize
+	type contents struct{ Key string }
+	result := struct {
+		XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Contents              []contents
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if end < len(keys) {
+		result.IsTruncated, result.NextContinuationToken = true, strconv.Itoa(end)
+	} else {
+		end = len(keys)
+	}
+	for _, key := range keys[start:end] {
+		result.Contents = append(result.Contents, contents{key})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// readInto runs read with a CacheWriter like a fill does and returns what it
+// wrote
+func readInto(read func(w *CacheWriter) *StorageProviderError) (string, *cacheFill, *StorageProviderError) {
+	var buf bytes.Buffer
+	fill := newCacheFill("", read, "")
+	storageProviderError := read(&CacheWriter{fill: fill, Writer: &buf})
+	return buf.String(), fill, storageProviderError
+}
+
+func TestS3ClientAddressing(t *testing.T) {
+	const key, content = "dir/file name+1.txt", "hello, world"
+	stub := newS3Stub(t, map[string]string{key: content})
+	for _, pathStyle := range []bool{true, false} {
+		stub.styles = nil
+		client := stub.client(t, pathStyle)
+		stat, storageProviderError := client.Stat(key)
+		if storageProviderError != nil {
+			t.Fatal(storageProviderError)
+		}
+		if stat.SizeInBytes != uint64(len(content)) || stat.ETag == "" || stat.LastModifiedAt.Unix() != 1500000000 {
+			t.Errorf("bad stat %+v", stat)
+		}
+		body, fill, storageProviderError := readInto(func(w *CacheWriter) *StorageProviderError {
+			return client.Read(key, w)
+		})
+		if storageProviderError != nil || body != content || fill.size != int64(len(content)) || fill.stat.ETag != stat.ETag {
+			t.Errorf("bad read %q %d %v", body, fill.size, storageProviderError)
+		}
+		_, storageProviderError = client.Stat("missing")
+		if storageProviderError == nil || storageProviderError.status != http.StatusNotFound {
+			t.Errorf("expected 404, got %v", storageProviderError)
+		}
+		want := "virtual-hosted"
+		if pathStyle {
+			want = "path"
+		}
+		for _, style := range stub.styles {
+			if style != want {
+				t.Errorf("expected %s requests, got %v", want, stub.styles)
+			}
+		}
+	}
+}
+
+func TestS3ClientBadKeys(t *testing.T) {
+	stub := newS3Stub(t, map[string]string{"a": "a"})
+	client := stub.client(t, true)
+	client.keys.SecretKey = "wrong"
+	_, storageProviderError := client.Stat("a")
+	if storageProviderError == nil || storageProviderError.status != http.StatusForbidden {
+		t.Errorf("expected 403, got %v", storageProviderError)
+	}
+}
+
+func TestS3ClientReadRange(t *testing.T) {
+	stub := newS3Stub(t, map[string]string{"video.mp4": "0123456789"})
+	client := stub.client(t, false)
+	version, storageProviderError := client.Stat("video.mp4")
+	if storageProviderError != nil {
+		t.Fatal(storageProviderError)
+	}
+	body, fill, storageProviderError := readInto(func(w *CacheWriter) *StorageProviderError {
+		return client.ReadRange("video.mp4", 2, 5, version, w)
+	})
+	if storageProviderError != nil || body != "23456" || fill.size != 5 {
+		t.Errorf("bad range %q %d %v", body, fill.size, storageProviderError)
+	}
+
+	stub.objects["video.mp4"] = "9876543210"
+	body, _, storageProviderError = readInto(func(w *CacheWriter) *StorageProviderError {
+		return client.ReadRange("video.mp4", 2, 5, version, w)
+	})
+	if storageProviderError == nil || storageProviderError.status != http.StatusPreconditionFailed || body != "" {
+		t.Errorf("expected 412 for a changed object, got %q %v", body, storageProviderError)
+	}
+}
+
+func TestS3ClientList(t *testing.T) {
+	stub := newS3Stub(t, map[string]string{
+		"list/a": "", "list/b": "", "list/c": "", "list/d/": "", "list/d/e": "", "other": "",
+	})
+	client := stub.client(t, true)
+	paths, storageProviderError := client.List("list/")
+	if storageProviderError != nil {
+		t.Fatal(storageProviderError)
+	}
+	want := []string{"list/a", "list/b", "list/c", "list/d/e"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v, want %v", paths, want)
+	}
+	if stub.listings != 3 {
+		t.Errorf("expected 3 pages, got %d", stub.listings)
+	}
+}
+
+func TestGetS3Client(t *testing.T) {
+	tests := []struct {
+		config Configuration
+		url    string
+	}{
+		{Configuration{S3Bucket: "bucket"}, "https://bucket.s3.amazonaws.com/a%20b"},
+		{Configuration{S3Bucket: "bucket", S3Region: "eu-west-3"}, "https://bucket.s3.eu-west-3.amazonaws.com/a%20b"},
+		{Configuration{S3Bucket: "my.bucket"}, "https://s3.amazonaws.com/my.bucket/a%20b"},
+		{Configuration{S3Bucket: "bucket", S3Endpoint: "http://minio:9000", S3PathStyle: true}, "http://minio:9000/bucket/a%20b"},
+	}
+	for _, test := range tests {
+		client, err := GetS3Client(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := client.buildS3Url("a b").String(); got != test.url {
+			t.Errorf("got %s, want %s", got, test.url)
+		}
+	}
+	_, err := GetS3Client(Configuration{S3Bucket: "bucket", S3Endpoint: "ftp://minio"})
+	if err == nil {
+		t.Error("expected an error for a non http endpoint")
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Files of at least sliceThreshold bytes are cached in slices of sliceSize
+// bytes fetched with range requests to origin. Each slice is a file of its own
+// in the cache so that an interrupted download still caches the slices that
+// completed, range requests only fetch the slices they need and eviction
+// removes slices individually. The file's record in the database holds its size
+// and validators.
+
+// sliceDirSuffix is appended to a file's path to name the directory holding
+// its slices, client paths can't contain it
+const sliceDirSuffix = "@slices"
+
+// buildSlicePath returns the cache path of a slice. Slices live in a directory
+// named after the version of the file so that slices of different versions
+// never get mixed.
+func (c *Cache) buildSlicePath(path string, record FileRecord, index int64) string {
+	version := fmt.Sprintf("%s|%d|%d|%d", record.ETag, record.LastModifiedAt.Unix(), record.SizeInBytes, c.sliceSize)
+	hash := sha1.Sum([]byte(version))
+	return fmt.Sprintf("%s%s/%x/%d", path, sliceDirSuffix, hash[:8], index)
+}
+
+// sliceRecord returns the record of path if it should be served in slices.
+// originStat is what origin answered when revalidating a whole cached copy,
+// if it was asked. Otherwise origin is asked for the size of files without a
+// record and of stale files cached in slices, files cached whole are only
+// checked again when they are revalidated.
+func (c *Cache) sliceRecord(path string, lastModifiedAt time.Time, originStat *Stat) (FileRecord, bool, *CacheError) {
+	record, found, err := GetFile(c.db, path)
+	if err != nil {
+		return record, false, &CacheError{http.StatusInternalServerError, err}
+	}
+	if originStat != nil {
+		return c.recordSlicedFile(path, record, found && record.Sliced, *originStat)
+	}
+	if found && !record.Sliced {
+		return record, false, nil
+	}
+	known := found
+	now := time.Now()
+	// like revalidate, limit checks asked for by modified to one per interval
+	recentlyValidated := c.revalidateInterval > 0 && now.Sub(record.ValidatedAt) < c.revalidateInterval
+	if known && (recentlyValidated || !record.ValidatedAt.Before(lastModifiedAt)) {
+		stale := record.expired(now) ||
+			(c.revalidateInterval > 0 && now.Sub(record.ValidatedAt) >= c.revalidateInterval)
+		if stale && record.staleFor(now) < c.staleWhileRevalidate {
+			c.revalidateInBackground(path, func() {
+				c.statSlicedFile(path, record, known)
+			})
+			stale = false
+		}
+		if !stale {
+			err = PutFile(c.db, path)
+			if err != nil {
+				return record, false, &CacheError{http.StatusInternalServerError, err}
+			}
+			return record, true, nil
+		}
+	}
+	return c.statSlicedFile(path, record, known)
+}
+
+// statSlicedFile asks origin for the size and validators of path and records
+// them if it should be served in slices. known tells whether record is the
+// one of a file cached in slices, which is kept if origin fails. Origins that
+// don't allow HEAD get the file fetched whole.
+func (c *Cache) statSlicedFile(path string, record FileRecord, known bool) (FileRecord, bool, *CacheError) {
+	stat, storageProviderError := c.statOrigin(path)
+	if storageProviderError != nil {
+		if storageProviderError.status == http.StatusMethodNotAllowed ||
+			storageProviderError.status == http.StatusNotImplemented {
+			return record, false, nil
+		}
+		now := time.Now()
+		if known && storageProviderError.status != http.StatusNotFound &&
+			(!record.expired(now) || record.staleFor(now) < c.staleIfError) {
+			log.Printf("failed to revalidate %s: %s", path, storageProviderError)
+			return record, true, nil
+		}
+		return record, false, &CacheError{storageProviderError.status, storageProviderError}
+	}
+	return c.recordSlicedFile(path, record, known, stat)
+}
+
+// recordSlicedFile records stat, origin's answer for path, if the file should
+// be served in slices
+func (c *Cache) recordSlicedFile(path string, record FileRecord, known bool, stat Stat) (FileRecord, bool, *CacheError) {
+	if stat.SizeInBytes < c.sliceThreshold || stat.NoStore {
+		return record, false, nil
+	}
+	c.applyDefaultTTL(&stat)
+	if !known {
+		// the file may have been cached whole while it was smaller, its old
+		// copy must neither be served nor keep taking up space
+		c.removeFile(path)
+	}
+	record, err := PutSlicedFile(c.db, path, stat)
+	if err != nil {
+		return record, false, &CacheError{http.StatusInternalServerError, err}
+	}
+	return record, true, nil
+}
+
+type slice struct {
+	*os.File
+	fill *cacheFill
+}
+
+// openSlice opens a cached slice or joins the fill fetching it from origin
+func (c *Cache) openSlice(path string, record FileRecord, index int64) (slice, *CacheError) {
+	slicePath := c.buildSlicePath(path, record, index)
+	file, err := os.Open(c.buildCachePath(slicePath))
+	if err == nil {
+		err = PutFile(c.db, slicePath)
+		if err != nil {
+			file.Close()
+			return slice{}, &CacheError{http.StatusInternalServerError, err}
+		}
+		cacheLookups.WithLabelValues(cacheHit).Inc()
+		return slice{File: file}, nil
+	}
+	cacheLookups.WithLabelValues(cacheMiss).Inc()
+	offset := index * c.sliceSize
+	length := int64(record.SizeInBytes) - offset
+	if length > c.sliceSize {
+		length = c.sliceSize
+	}
+	version := Stat{ETag: record.ETag, SizeInBytes: record.SizeInBytes, LastModifiedAt: record.LastModifiedAt}
+	fill, file, err := c.joinFill(slicePath, func(w *CacheWriter) *StorageProviderError {
+		return c.storageProvider.ReadRange(path, offset, length, version, w)
+	})
+	if err != nil {
+		return slice{}, &CacheError{http.StatusInternalServerError, err}
+	}
+	storageProviderError := fill.waitStarted()
+	if storageProviderError != nil {
+		file.Close()
+		if storageProviderError.status == http.StatusPreconditionFailed {
+			// origin has a new version, the next request asks for its size
+			DeleteFile(c.db, path)
+			return slice{}, &CacheError{http.StatusBadGateway, storageProviderError}
+		}
+		return slice{}, &CacheError{storageProviderError.status, storageProviderError}
+	}
+	return slice{File: file, fill: fill}, nil
+}
+
+// copySlice copies bytes [start, end) of a slice to a client
+func (c *Cache) copySlice(s slice, cacheClient CacheClient, start int64, end int64) *CacheError {
+	if s.fill != nil {
+		return c.copyFill(s.fill, s.File, cacheClient, start, end)
+	}
+	n, err := io.Copy(cacheClient, io.NewSectionReader(s.File, start, end-start))
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	if err != nil {
+		return &CacheError{http.StatusRequestTimeout, errors.New("client went away")}
+	}
+	if n != end-start {
+		return &CacheError{http.StatusInternalServerError, errors.New("truncated slice")}
+	}
+	return nil
+}
+
+// serveSliced serves the slices of path covering the requested range
+func (c *Cache) serveSliced(path string, record FileRecord, cacheClient CacheClient) *CacheError {
+	if notModified(cacheClient.req, record.ETag, record.LastModifiedAt) {
+		header := cacheClient.Header()
+		writeStoredHeader(header, path, record.Header)
+		writeAge(header, record.ValidatedAt)
+		// like http.ServeContent, leave out the headers describing a body
+		header.Del("Content-Type")
+		header.Del("Content-Encoding")
+		if header.Get("ETag") != "" {
+			header.Del("Last-Modified")
+		}
+		cacheClient.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	size := int64(record.SizeInBytes)
+	start, end, partial, cacheError := resolveRange(cacheClient, size, record.ETag)
+	if cacheError != nil {
+		return cacheError
+	}
+	first := start / c.sliceSize
+	last := (end - 1) / c.sliceSize
+
+	// only commit to a response once the first slice is known to be available
+	s, cacheError := c.openSlice(path, record, first)
+	if cacheError != nil {
+		return cacheError
+	}
+	header := cacheClient.Header()
+	writeStoredHeader(header, path, record.Header)
+	writeAge(header, record.ValidatedAt)
+	header.Set("Accept-Ranges", "bytes")
+	writeRangeHeader(header, start, end, size, partial)
+	if partial {
+		cacheClient.WriteHeader(http.StatusPartialContent)
+	}
+	for index := first; index <= last; index++ {
+		if index != first {
+			s, cacheError = c.openSlice(path, record, index)
+			if cacheError != nil {
+				return cacheError
+			}
+		}
+		sliceStart := index * c.sliceSize
+		from, to := start-sliceStart, end-sliceStart
+		if from < 0 {
+			from = 0
+		}
+		if to > c.sliceSize {
+			to = c.sliceSize
+		}
+		cacheError = c.copySlice(s, cacheClient, from, to)
+		s.Close()
+		if cacheError != nil {
+			return cacheError
+		}
+	}
+	return nil
+}
+
+// notModified reports whether the client of a GET or HEAD request already
+// has the version of a file with etag modified at modifiedAt, going by
+// If-None-Match or, without it, If-Modified-Since like http.ServeContent
+func notModified(r *http.Request, etag string, modifiedAt time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			// weak comparison, as for GET and HEAD
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modifiedAt.IsZero() {
+		return false
+	}
+	return !modifiedAt.Truncate(time.Second).After(ifModifiedSince)
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+const slicedBody = "0123456789abcdefghij"
+
+func newSlicedTestCache(t *testing.T, files map[string]stubFile) (*Cache, *stubProvider) {
+	provider := newStubProvider(files)
+	c := newTestCache(t, Configuration{SliceSizeInBytes: 4, SliceThresholdInBytes: 8}, provider)
+	return c, provider
+}
+
+// checkSlices fails unless exactly the slices of path listed in cached are
+// on disk
+func checkSlices(t *testing.T, c *Cache, path string, cached ...int64) {
+	t.Helper()
+	record, found, err := GetFile(c.db, path)
+	if err != nil || !found || !record.Sliced {
+		t.Fatalf("%s isn't cached in slices (%v)", path, err)
+	}
+	isCached := make(map[int64]bool)
+	for _, index := range cached {
+		isCached[index] = true
+	}
+	slices := (int64(record.SizeInBytes) + c.sliceSize - 1) / c.sliceSize
+	for index := int64(0); index < slices; index++ {
+		_, err := os.Stat(c.buildCachePath(c.buildSlicePath(path, record, index)))
+		if (err == nil) != isCached[index] {
+			t.Errorf("slice %d cached: %v, want %v", index, err == nil, isCached[index])
+		}
+	}
+}
+
+func TestSliceAddressing(t *testing.T) {
+	c, provider := newSlicedTestCache(t, map[string]stubFile{"big": {body: slicedBody, etag: `"v1"`}})
+
+	w, cacheError := get(c, "big", http.Header{"Range": {"bytes=5-10"}})
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Code != http.StatusPartialContent || w.Body.String() != "56789a" {
+		t.Errorf("got %d %q, want 206 \"56789a\"", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 5-10/20" {
+		t.Errorf("got Content-Range %s", got)
+	}
+	// only the slices covering the range are fetched
+	if n := provider.count("ReadRange big"); n != 2 {
+		t.Errorf("origin got %d range reads, want 2", n)
+	}
+	checkSlices(t, c, "big", 1, 2)
+	if _, err := os.Stat(c.buildCachePath("big")); err == nil {
+		t.Error("sliced file cached whole")
+	}
+
+	w, cacheError = get(c, "big", http.Header{"Range": {"bytes=-2"}})
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != "ij" {
+		t.Errorf("got %q, want \"ij\"", w.Body.String())
+	}
+	checkSlices(t, c, "big", 1, 2, 4)
+
+	w, cacheError = get(c, "big", nil)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != slicedBody {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), slicedBody)
+	}
+	checkSlices(t, c, "big", 0, 1, 2, 3, 4)
+	if n := provider.count("ReadRange big"); n != 5 {
+		t.Errorf("origin got %d range reads, want 5", n)
+	}
+	if n := provider.count("Stat big") + provider.count("Read big"); n != 1 {
+		t.Errorf("origin got %d stats and reads, want 1", n)
+	}
+}
+
+func TestSliceChangedAtOrigin(t *testing.T) {
+	c, provider := newSlicedTestCache(t, map[string]stubFile{"big": {body: slicedBody, etag: `"v1"`}})
+	_, cacheError := get(c, "big", http.Header{"Range": {"bytes=0-3"}})
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+
+	changed := "ABCDEFGHIJKLMNOPQRST"
+	provider.setFile("big", stubFile{body: changed, etag: `"v2"`})
+	// cached slices of the old version are still served
+	w, cacheError := get(c, "big", http.Header{"Range": {"bytes=0-3"}})
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != "0123" {
+		t.Errorf("got %q, want \"0123\"", w.Body.String())
+	}
+	// a slice that has to be fetched fails with 412 and drops the record
+	_, cacheError = get(c, "big", http.Header{"Range": {"bytes=4-7"}})
+	if cacheError == nil || cacheError.status != http.StatusBadGateway {
+		t.Fatalf("got %v, want a 502 error", cacheError)
+	}
+	if found, _ := HasFile(c.db, "big"); found {
+		t.Error("record of the old version kept")
+	}
+	w, cacheError = get(c, "big", nil)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != changed {
+		t.Errorf("got %q, want %q", w.Body.String(), changed)
+	}
+}
+
+func TestSliceWholeCopyGrown(t *testing.T) {
+	// max-age=0 makes every request revalidate
+	header := http.Header{"Cache-Control": {"max-age=0"}}
+	c, provider := newSlicedTestCache(t, map[string]stubFile{"file": {body: "small", etag: `"v1"`, header: header}})
+	for i := 0; i < 2; i++ {
+		w, cacheError := get(c, "file", nil)
+		if cacheError != nil {
+			t.Fatal(cacheError)
+		}
+		if w.Body.String() != "small" {
+			t.Errorf("got %q, want \"small\"", w.Body.String())
+		}
+	}
+	checkCached(t, c, "file", "small")
+	// one stat for the miss and one for the revalidation, none for slicing
+	if n := provider.count("Stat file"); n != 2 {
+		t.Errorf("origin got %d stats, want 2", n)
+	}
+	if n := provider.count("Read file"); n != 1 {
+		t.Errorf("origin got %d reads, want 1", n)
+	}
+
+	provider.setFile("file", stubFile{body: slicedBody, etag: `"v2"`, header: header})
+	w, cacheError := get(c, "file", nil)
+	if cacheError != nil {
+		t.Fatal(cacheError)
+	}
+	if w.Body.String() != slicedBody {
+		t.Errorf("got %q, want %q", w.Body.String(), slicedBody)
+	}
+	// the revalidation's stat tells the file is now served in slices
+	if n := provider.count("Stat file"); n != 3 {
+		t.Errorf("origin got %d stats, want 3", n)
+	}
+	if _, err := os.Stat(c.buildCachePath("file")); err == nil {
+		t.Error("whole copy kept")
+	}
+	checkSlices(t, c, "file", 0, 1, 2, 3, 4)
+}
+
+func TestSliceHeadNotAllowed(t *testing.T) {
+	for _, status := range []int{http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+		c, provider := newSlicedTestCache(t, map[string]stubFile{"file": {body: slicedBody, statStatus: status}})
+		w, cacheError := get(c, "file", nil)
+		if cacheError != nil {
+			t.Fatalf("%d: %s", status, cacheError)
+		}
+		if w.Body.String() != slicedBody {
+			t.Errorf("%d: got %q, want %q", status, w.Body.String(), slicedBody)
+		}
+		if n := provider.count("Read file"); n != 1 {
+			t.Errorf("%d: origin got %d reads, want 1", status, n)
+		}
+		checkCached(t, c, "file", slicedBody)
+	}
+}
+
+func TestSliceConditionalRequests(t *testing.T) {
+	lastModified := "Thu, 01 Jun 2017 12:00:00 GMT"
+	c, provider := newSlicedTestCache(t, map[string]stubFile{"big": {
+		body:   slicedBody,
+		etag:   `"v1"`,
+		header: http.Header{"Last-Modified": {lastModified}, "Content-Type": {"video/mp4"}},
+	}})
+	tests := []struct {
+		header http.Header
+		status int
+	}{
+		{http.Header{"If-None-Match": {`"v1"`}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"v0", W/"v1"`}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified},
+		{http.Header{"If-Modified-Since": {"Fri, 02 Jun 2017 12:00:00 GMT"}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"v0"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+		{http.Header{"If-None-Match": {`"v0"`}}, http.StatusOK},
+		{http.Header{"If-Modified-Since": {"Wed, 31 May 2017 12:00:00 GMT"}}, http.StatusOK},
+		{http.Header{"If-Modified-Since": {"garbage"}}, http.StatusOK},
+	}
+	for _, test := range tests {
+		reads := provider.count("ReadRange big")
+		w, cacheError := get(c, "big", test.header)
+		if cacheError != nil {
+			t.Fatal(cacheError)
+		}
+		if w.Code != test.status {
+			t.Errorf("%v: got %d, want %d", test.header, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusNotModified {
+			if w.Body.String() != slicedBody {
+				t.Errorf("%v: got %q, want %q", test.header, w.Body.String(), slicedBody)
+			}
+			continue
+		}
+		if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" || w.Header().Get("Content-Length") != "" {
+			t.Errorf("%v: 304 with a body or its headers", test.header)
+		}
+		if w.Header().Get("ETag") != `"v1"` {
+			t.Errorf("%v: 304 without ETag", test.header)
+		}
+		if n := provider.count("ReadRange big"); n != reads {
+			t.Errorf("%v: 304 fetched %d slices", test.header, n-reads)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// GetACMEManager returns a manager obtaining and renewing certificates for
+// ACMEHosts from ACMEDirectoryURL, Let's Encrypt by default, or nil if
+// ACMEHosts is empty. Certificates are kept in ACMECacheDir.
+func GetACMEManager(config Configuration) *autocert.Manager {
+	if len(config.ACMEHosts) == 0 {
+		return nil
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(config.ACMEHosts...),
+		Email:      config.ACMEEmail,
+	}
+	if config.ACMEDirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: config.ACMEDirectoryURL}
+	}
+	return manager
+}
+
+// ServeTLS serves handler over HTTPS on listener, with the certificates of
+// acmeManager if it isn't nil or else with TLSCertFile and TLSKeyFile, which
+// can't both be configured
+func ServeTLS(config Configuration, listener net.Listener, handler http.Handler, acmeManager *autocert.Manager) error {
+	server := &http.Server{
+		Addr:      config.TLSListen,
+		Handler:   handler,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	if acmeManager != nil {
+		server.TLSConfig = acmeManager.TLSConfig()
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+}
+
+// HTTPHandler wraps the handler served on Listen so that it answers ACME
+// challenges and, if RedirectToHTTPS is set, redirects everything else to
+// TLSListen
+func HTTPHandler(config Configuration, handler http.Handler, acmeManager *autocert.Manager) http.Handler {
+	if config.RedirectToHTTPS {
+		handler = makeHTTPSRedirect(config)
+	}
+	if acmeManager != nil {
+		handler = acmeManager.HTTPHandler(handler)
+	}
+	return handler
+}
+
+func makeHTTPSRedirect(config Configuration) http.Handler {
+	_, port, _ := net.SplitHostPort(config.TLSListen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := remoteHost(r.Host)
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
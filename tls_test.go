@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMakeHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		tlsListen string
+		host      string
+		want      string
+	}{
+		{":443", "cdn.example.com", "https://cdn.example.com/a/b?c=d"},
+		{":443", "cdn.example.com:80", "https://cdn.example.com/a/b?c=d"},
+		{":8443", "cdn.example.com:8080", "https://cdn.example.com:8443/a/b?c=d"},
+		{":443", "[2001:db8::1]", "https://[2001:db8::1]/a/b?c=d"},
+		{":443", "[2001:db8::1]:80", "https://[2001:db8::1]/a/b?c=d"},
+		{":8443", "[2001:db8::1]", "https://[2001:db8::1]:8443/a/b?c=d"},
+		{":8443", "[2001:db8::1]:8080", "https://[2001:db8::1]:8443/a/b?c=d"},
+	}
+	for _, test := range tests {
+		handler := makeHTTPSRedirect(Configuration{TLSListen: test.tlsListen})
+		r := httptest.NewRequest("GET", "/a/b?c=d", nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Location"); got != test.want {
+			t.Errorf("redirect of %s to %s = %s, want %s", test.host, test.tlsListen, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	pathLib "path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTTL sets how long files matching Pattern stay fresh when origin
+// sends neither Cache-Control max-age nor Expires. Patterns without a slash
+// are matched against the file name, others against the whole path.
+type DefaultTTL struct {
+	Pattern      string
+	TTLInSeconds int64
+}
+
+// matches reports whether path is covered by the pattern of ttl
+func (ttl DefaultTTL) matches(path string) bool {
+	name := path
+	if !strings.Contains(ttl.Pattern, "/") {
+		name = pathLib.Base(path)
+	}
+	matched, _ := pathLib.Match(ttl.Pattern, name)
+	return matched
+}
+
+// applyCacheHeaders sets ExpiresAt and NoStore on stat from the Cache-Control
+// and Expires headers of an origin response received at now
+func applyCacheHeaders(stat *Stat, header http.Header, now time.Time) {
+	maxAge, sharedMaxAge, noCache := int64(-1), int64(-1), false
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg := strings.TrimSpace(directive), ""
+			if i := strings.Index(name, "="); i >= 0 {
+				name, arg = name[:i], strings.Trim(name[i+1:], `"`)
+			}
+			switch strings.ToLower(name) {
+			case "no-store", "private":
+				// a private response is for a single user, not a shared cache
+				stat.NoStore = true
+			case "no-cache":
+				noCache = true
+			case "max-age":
+				if seconds, err := strconv.ParseInt(arg, 10, 64); err == nil {
+					maxAge = seconds
+				}
+			case "s-maxage":
+				if seconds, err := strconv.ParseInt(arg, 10, 64); err == nil {
+					sharedMaxAge = seconds
+				}
+			}
+		}
+	}
+	if noCache {
+		// whatever the other directives say, revalidate every time
+		maxAge = 0
+	} else if sharedMaxAge >= 0 {
+		maxAge = sharedMaxAge
+	}
+	if maxAge >= 0 {
+		stat.ExpiresAt = now.Add(time.Duration(maxAge) * time.Second)
+		return
+	}
+	expires := header.Get("Expires")
+	if expires == "" {
+		return
+	}
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		// an invalid Expires, such as "0", means already expired
+		stat.ExpiresAt = now
+		return
+	}
+	// use the lifetime origin meant rather than its clock
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		expiresAt = now.Add(expiresAt.Sub(date))
+	}
+	stat.ExpiresAt = expiresAt
+}
+
+// applyDefaultTTL sets ExpiresAt from the first default TTL matching the path
+// of stat when origin didn't say how long it stays fresh
+func (c *Cache) applyDefaultTTL(stat *Stat) {
+	if !stat.ExpiresAt.IsZero() {
+		return
+	}
+	for _, ttl := range c.defaultTTLs {
+		if ttl.matches(stat.Path) {
+			stat.ExpiresAt = time.Now().Add(time.Duration(ttl.TTLInSeconds) * time.Second)
+			return
+		}
+	}
+}
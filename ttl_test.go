@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2017 Salle, Alexandre <atsalle@inf.ufrgs.br>
+ * Author: Salle, Alexandre <atsalle@inf.ufrgs.br>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestApplyCacheHeaders(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	httpDate := func(t time.Time) string { return t.Format(http.TimeFormat) }
+	tests := []struct {
+		name         string
+		cacheControl []string
+		expires      string
+		date         string
+		expiresIn    time.Duration // -1 if ExpiresAt stays zero
+		noStore      bool
+	}{
+		{"no headers", nil, "", "", -1, false},
+		{"max-age", []string{"public, max-age=60"}, "", "", time.Minute, false},
+		{"quoted max-age", []string{`max-age="60"`}, "", "", time.Minute, false},
+		{"upper case", []string{"MAX-AGE=60"}, "", "", time.Minute, false},
+		{"several headers", []string{"public", "max-age=60"}, "", "", time.Minute, false},
+		{"s-maxage wins over max-age", []string{"max-age=60, s-maxage=300"}, "", "", 5 * time.Minute, false},
+		{"no-cache wins over s-maxage", []string{"no-cache, s-maxage=300"}, "", "", 0, false},
+		{"no-store", []string{"no-store"}, "", "", -1, true},
+		{"private", []string{"private, max-age=60"}, "", "", time.Minute, true},
+		{"max-age wins over Expires", []string{"max-age=60"}, httpDate(now.Add(time.Hour)), "", time.Minute, false},
+		{"bad max-age falls back to Expires", []string{"max-age=abc"}, httpDate(now.Add(time.Hour)), "", time.Hour, false},
+		{"Expires", nil, httpDate(now.Add(time.Hour)), "", time.Hour, false},
+		{"Expires relative to a slow origin clock", nil, httpDate(now.Add(-time.Hour + 2*time.Minute)), httpDate(now.Add(-time.Hour)), 2 * time.Minute, false},
+		{"Expires relative to a fast origin clock", nil, httpDate(now.Add(time.Hour + 2*time.Minute)), httpDate(now.Add(time.Hour)), 2 * time.Minute, false},
+		{"invalid Expires", nil, "0", "", 0, false},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		for _, value := range test.cacheControl {
+			header.Add("Cache-Control", value)
+		}
+		if test.expires != "" {
+			header.Set("Expires", test.expires)
+		}
+		if test.date != "" {
+			header.Set("Date", test.date)
+		}
+		var stat Stat
+		applyCacheHeaders(&stat, header, now)
+		if stat.NoStore != test.noStore {
+			t.Errorf("%s: got NoStore %v, want %v", test.name, stat.NoStore, test.noStore)
+		}
+		if test.expiresIn < 0 {
+			if !stat.ExpiresAt.IsZero() {
+				t.Errorf("%s: got ExpiresAt %s, want none", test.name, stat.ExpiresAt)
+			}
+			continue
+		}
+		if want := now.Add(test.expiresIn); !stat.ExpiresAt.Equal(want) {
+			t.Errorf("%s: got ExpiresAt %s, want %s", test.name, stat.ExpiresAt, want)
+		}
+	}
+}